@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/metrics"
+	"github.com/natemarks/cache_clone/scheduler"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var bundleDir string
+var exportAll bool
+
+// bundleCmd groups the bundle export and import commands
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Move mirrors to and from environments without a path to the git server",
+	Long: `Export mirrors as git bundle files with a manifest, carry the directory across,
+                     then import it under the mirror root on the other side`,
+}
+
+// bundleExportCmd represents the bundle export command
+var bundleExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write mirrors as git bundles with a manifest",
+	Long: `Write the mirror of --remote, or every mirror with --all, to --dir as git bundles.
+                     manifest.json lists the remote URL, refs and SHA-256 of each bundle`,
+	Run: func(cmd *cobra.Command, args []string) {
+		log := config.GetLogger(settings)
+		ctx, report, span := start("bundle export", &log)
+		err := runBundleExport(ctx, &log)
+		finish(report, span, err, &log)
+	},
+}
+
+// bundleImportCmd represents the bundle import command
+var bundleImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Create or update mirrors from exported git bundles",
+	Long: `Check each bundle in --dir against manifest.json and create or update its mirror
+                     under the mirror root. Clone with --offline to use the imported mirrors
+                     without reaching the git server`,
+	Run: func(cmd *cobra.Command, args []string) {
+		log := config.GetLogger(settings)
+		ctx, report, span := start("bundle import", &log)
+		err := runBundleImport(ctx, &log)
+		finish(report, span, err, &log)
+	},
+}
+
+// runBundleExport writes the selected mirrors and the manifest to bundleDir
+func runBundleExport(ctx context.Context, log *zerolog.Logger) error {
+	var mirrors []*types.Mirror
+	if exportAll {
+		perms, err := config.ParsePermissions(settings)
+		if err != nil {
+			return &types.Error{Class: types.ErrorClassFilesystem, Msg: "invalid mirror permissions", Err: err}
+		}
+		paths, err := scheduler.FindMirrors(settings.Mirror)
+		if err != nil {
+			return &types.Error{Class: types.ErrorClassFilesystem, Msg: "unable to scan mirror root " + settings.Mirror, Err: err}
+		}
+		for _, p := range paths {
+			mirrors = append(mirrors, &types.Mirror{Path: p, Perms: perms})
+		}
+	} else {
+		if _, err := types.NewRemote(settings.Remote); err != nil {
+			return &types.Error{Class: types.ErrorClassUnknown, Msg: "--remote or --all is required", Err: err}
+		}
+		m := types.NewMirror(settings, log)
+		if !m.CheckClone(ctx, log) {
+			return &types.Error{Class: types.ErrorClassFilesystem, Msg: "no mirror at " + m.Path}
+		}
+		mirrors = append(mirrors, m)
+	}
+	if err := os.MkdirAll(bundleDir, 0777); err != nil {
+		return &types.Error{Class: types.ErrorClassFilesystem, Msg: "unable to create " + bundleDir, Err: err}
+	}
+	manifest := types.Manifest{Created: time.Now().UTC()}
+	for _, m := range mirrors {
+		meta, err := m.ExportBundle(ctx, bundleDir)
+		if err != nil {
+			return err
+		}
+		log.Info().Msgf("exported %s to %s (%d bytes)", m.Path, meta.File, meta.Size)
+		manifest.Bundles = append(manifest.Bundles, meta)
+	}
+	return manifest.Write(bundleDir)
+}
+
+// runBundleImport creates or updates a mirror for each bundle in the manifest
+func runBundleImport(ctx context.Context, log *zerolog.Logger) error {
+	if err := types.CheckMirrorRoot(settings); err != nil {
+		return err
+	}
+	manifest, err := types.ReadManifest(bundleDir)
+	if err != nil {
+		return err
+	}
+	for _, meta := range manifest.Bundles {
+		if _, err = types.NewRemote(meta.Remote); err != nil {
+			return &types.Error{Class: types.ErrorClassFilesystem, Msg: "invalid remote in bundle manifest", Err: err}
+		}
+		s := settings
+		s.Remote = meta.Remote
+		m := types.NewMirror(s, log)
+		if err = m.ImportBundle(ctx, bundleDir, meta, log); err != nil {
+			return err
+		}
+		metrics.ObserveMirrorSize(metrics.Default, meta.Remote, m.Path)
+		log.Info().Msgf("imported %s to %s (%s)", meta.File, m.Path, m.Action)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(bundleCmd)
+	bundleCmd.AddCommand(bundleExportCmd)
+	bundleCmd.AddCommand(bundleImportCmd)
+
+	bundleCmd.PersistentFlags().StringVar(&bundleDir, "dir", "", "directory of the bundle files and manifest.json")
+	bundleCmd.MarkPersistentFlagRequired("dir")
+	bundleExportCmd.Flags().BoolVar(&exportAll, "all", false, "export every mirror under the mirror root instead of the --remote mirror")
+}
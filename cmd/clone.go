@@ -1,11 +1,17 @@
 package cmd
 
 import (
+	"context"
+	"time"
+
 	"github.com/natemarks/cache_clone/config"
 	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
 )
 
+var reuseLocal, replaceLocal bool
+
 // cloneCmd represents the clone command
 var cloneCmd = &cobra.Command{
 	Use:   "clone",
@@ -15,22 +21,105 @@ var cloneCmd = &cobra.Command{
                      Clone using the local mirror`,
 	Run: func(cmd *cobra.Command, args []string) {
 		log := config.GetLogger(settings)
-		log.Debug().Msg("Getting credentials from AWS Secret Manager")
-		creds := *types.NewCredential(settings, &log)
-		log.Debug().Msg("ensure the mirror is cloned")
-		m := types.NewMirror(settings, &log)
-		if m.CheckClone(&log) {
-			log.Debug().Msg("mirror is already cloned. updating the mirror")
-			m.UpdateClone(&log)
-		} else {
-			log.Debug().Msg("mirror doesn't exist. creating the mirror")
-			m.CreateClone(*types.NewHTTPSRemote(settings.Remote), creds, &log)
-		}
-		log.Debug().Msgf("cloning the mirror to: %s", settings.Local)
-		m.MakeLocal(settings.Local, &log)
+		ctx, report, span := start("clone", &log)
+		err := runClone(ctx, report, &log)
+		finish(report, span, err, &log)
 	},
 }
 
+// runClone creates or updates the mirror and clones it to the local directory
+func runClone(ctx context.Context, report *types.Report, log *zerolog.Logger) error {
+	if err := types.CheckMirrorRoot(settings); err != nil {
+		return err
+	}
+	remote, err := parseRemote()
+	if err != nil {
+		return err
+	}
+	log.Debug().Msg("ensure the mirror is cloned")
+	m := types.NewMirror(settings, log)
+	report.MirrorPath = m.Path
+	err = updateMirror(ctx, m, *remote, report, log)
+	report.SetMirror(m)
+	if err != nil {
+		return err
+	}
+	if err = m.RecordAccess(); err != nil {
+		log.Warn().Err(err).Msgf("unable to record access to %s", m.Path)
+	}
+	log.Debug().Msgf("cloning the mirror to: %s", settings.Local)
+	if err = m.CloneLocal(ctx, settings.Local, localMode(), settings.Ref, *remote, log); err != nil {
+		return err
+	}
+	report.CommitSHA, err = types.HeadCommit(ctx, settings.Local)
+	return err
+}
+
+// parseRemote returns --remote without its userinfo, to fetch from
+// An invalid remote, or one whose mirror could be outside the mirror root, is an error
+func parseRemote() (*types.HTTPSRemote, error) {
+	remote, err := types.NewRemote(settings.Remote)
+	if err != nil {
+		return nil, &types.Error{Class: types.ErrorClassUnknown, Msg: "invalid --remote", Err: err}
+	}
+	return remote.Stripped(), nil
+}
+
+// updateMirror creates the mirror, or fetches it unless it is newer than --max-age
+// With --offline the existing mirror is used as is. With --allow-stale it is used
+// when the remote, or the credential needed to reach it, can't be reached
+func updateMirror(ctx context.Context, m *types.Mirror, remote types.HTTPSRemote, report *types.Report, log *zerolog.Logger) error {
+	cloned := m.CheckClone(ctx, log)
+	if settings.Offline {
+		report.Offline = true
+		if !cloned {
+			return &types.Error{Class: types.ErrorClassNetwork, Msg: "no mirror at " + m.Path + ". --offline never clones from the remote"}
+		}
+		log.Info().Msgf("offline. using mirror %s without fetching", m.Path)
+		m.Action = types.MirrorReused
+		return nil
+	}
+	if cloned && m.IsFreshFor(settings.MaxAge) {
+		// a fresh mirror doesn't need the network, not even for the credential
+		log.Info().Msgf("mirror was fetched less than %s ago. not fetching", settings.MaxAge)
+		m.Action = types.MirrorReused
+		return nil
+	}
+	log.Debug().Msg("Getting credentials from AWS Secret Manager")
+	creds, err := types.LoadCredential(ctx, settings, log)
+	if err == nil && !cloned {
+		log.Debug().Msg("mirror doesn't exist. creating the mirror")
+		return m.CreateClone(ctx, remote, *creds, log)
+	}
+	if err == nil {
+		log.Debug().Msg("mirror is already cloned. updating the mirror")
+		err = m.UpdateClone(ctx, remote, *creds, log)
+	}
+	if err == nil || !cloned || !settings.AllowStale || !types.IsUnreachable(err) {
+		return err
+	}
+	age := "an unknown time"
+	if fetched, fetchErr := m.LastFetched(); fetchErr == nil {
+		age = time.Since(fetched).Round(time.Second).String()
+	}
+	log.Warn().Err(err).Str("errorClass", types.ErrorClass(err)).Msgf("REMOTE UNREACHABLE. CLONING FROM A STALE MIRROR last fetched %s ago: %s", age, m.Path)
+	report.Stale = true
+	report.StaleError = config.Redact(err.Error())
+	m.Action = types.MirrorReused
+	return nil
+}
+
+// localMode returns what to do with an existing local directory
+func localMode() string {
+	switch {
+	case reuseLocal:
+		return types.LocalReuse
+	case replaceLocal:
+		return types.LocalReplace
+	}
+	return types.LocalFail
+}
+
 func init() {
 	rootCmd.AddCommand(cloneCmd)
 
@@ -43,4 +132,13 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// cloneCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	cloneCmd.Flags().StringVar(&settings.Report, "report", "", "write a JSON run report to this file")
+	cloneCmd.Flags().StringVar(&settings.Ref, "ref", "", "branch, tag or commit to check out. default: the remote default branch")
+	cloneCmd.Flags().BoolVar(&reuseLocal, "reuse", false, "if --local exists, fetch from the mirror and reset it to --ref")
+	cloneCmd.Flags().BoolVar(&replaceLocal, "replace", false, "if --local exists, delete it and clone again")
+	cloneCmd.Flags().DurationVar(&settings.MaxAge, "max-age", 0, "don't fetch a mirror fetched less than this long ago. example: 10m. 0 always fetches")
+	cloneCmd.Flags().BoolVar(&settings.Offline, "offline", false, "never contact the remote or AWS. clone the existing mirror as is")
+	cloneCmd.Flags().BoolVar(&settings.AllowStale, "allow-stale", false, "if the remote can't be reached, clone the existing mirror as is and mark the report stale")
+	cloneCmd.MarkFlagsMutuallyExclusive("reuse", "replace")
+	cloneCmd.MarkFlagsMutuallyExclusive("offline", "allow-stale")
 }
@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+)
+
+// closedURL returns an http URL nothing listens on
+func closedURL(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+// gitServer serves the repos under root over smart HTTP with git http-backend
+func gitServer(t *testing.T, root string) *httptest.Server {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("no git")
+	}
+	srv := httptest.NewServer(&cgi.Handler{
+		Path:   git,
+		Args:   []string{"http-backend"},
+		Env:    []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+		Stderr: io.Discard,
+	})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// secretsServer is a Secrets Manager stand-in that returns a basic credential
+func secretsServer(t *testing.T) *httptest.Server {
+	t.Setenv("AWS_ACCESS_KEY_ID", "a")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "b")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"Name":"x","SecretString":"{\"user\":\"bob\",\"token\":\"tok\"}"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// TestRunCloneNormalizedRemote clones a remote whose normalized URL the server doesn't
+// know. The mirror is named by the normalized URL and fetched from the given one
+func TestRunCloneNormalizedRemote(t *testing.T) {
+	repos := t.TempDir()
+	work := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "--bare", filepath.Join(repos, "org", "tool")},
+		{"init", "-q", work},
+		{"-C", work, "-c", "user.name=a", "-c", "user.email=a@b", "commit", "-q", "--allow-empty", "-m", "one"},
+		{"-C", work, "push", "-q", filepath.Join(repos, "org", "tool"), "HEAD:refs/heads/main"},
+		{"-C", filepath.Join(repos, "org", "tool"), "symbolic-ref", "HEAD", "refs/heads/main"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v %s", args, err, out)
+		}
+	}
+	remote := gitServer(t, repos).URL + "/org/tool"
+
+	saved := settings
+	defer func() { settings = saved }()
+	settings = config.Settings{
+		Mirror:         t.TempDir(),
+		Local:          filepath.Join(t.TempDir(), "local"),
+		Remote:         remote,
+		SecretID:       "x",
+		UserKey:        "user",
+		TokenKey:       "token",
+		AWSRegion:      "us-east-1",
+		AWSEndpointURL: secretsServer(t).URL,
+		BitbucketHosts: []string{"stash.example.com"},
+	}
+	log := zerolog.Nop()
+	report := types.NewReport("clone", settings)
+	if err := runClone(context.Background(), report, &log); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(report.MirrorPath, "/org/tool.git") {
+		t.Errorf("mirror path = %s, want the normalized remote", report.MirrorPath)
+	}
+	if report.CommitSHA == "" {
+		t.Error("nothing checked out")
+	}
+	// a second run fetches the existing mirror from the same URL
+	settings.Local = filepath.Join(t.TempDir(), "local")
+	if err := runClone(context.Background(), types.NewReport("clone", settings), &log); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUpdateMirrorOffline covers --offline and --allow-stale when the remote or
+// Secrets Manager is down, and the failures --allow-stale must not hide
+func TestUpdateMirrorOffline(t *testing.T) {
+	secrets := secretsServer(t)
+	missing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"no secret"}`))
+	}))
+	defer missing.Close()
+	remote := closedURL(t) + "/org/repo.git"
+
+	work := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", work},
+		{"-C", work, "-c", "user.name=a", "-c", "user.email=a@b", "commit", "-q", "--allow-empty", "-m", "one"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v %s", args, err, out)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		offline    bool
+		allowStale bool
+		cloned     bool
+		secrets    string
+		wantClass  string
+		wantStale  bool
+	}{
+		{name: "offline", offline: true, cloned: true},
+		{name: "offline without mirror", offline: true, wantClass: types.ErrorClassNetwork},
+		{name: "stale remote", allowStale: true, cloned: true, secrets: secrets.URL, wantStale: true},
+		{name: "stale secrets manager", allowStale: true, cloned: true, secrets: closedURL(t), wantStale: true},
+		{name: "missing secret", allowStale: true, cloned: true, secrets: missing.URL, wantClass: types.ErrorClassCredential},
+		{name: "remote down", cloned: true, secrets: secrets.URL, wantClass: types.ErrorClassNetwork},
+		{name: "stale without mirror", allowStale: true, secrets: secrets.URL, wantClass: types.ErrorClassNetwork},
+	}
+	saved := settings
+	defer func() { settings = saved }()
+	log := zerolog.Nop()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings = config.Settings{
+				Mirror:         t.TempDir(),
+				Remote:         remote,
+				SecretID:       "x",
+				UserKey:        "user",
+				TokenKey:       "token",
+				AWSRegion:      "us-east-1",
+				AWSEndpointURL: tt.secrets,
+				Offline:        tt.offline,
+				AllowStale:     tt.allowStale,
+			}
+			m := types.NewMirror(settings, &log)
+			if tt.cloned {
+				for _, args := range [][]string{{"clone", "-q", "--mirror", work, m.Path}, {"-C", m.Path, "remote", "set-url", "origin", remote}} {
+					if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+						t.Fatalf("git %v: %v %s", args, err, out)
+					}
+				}
+			}
+			report := types.NewReport("clone", settings)
+			err := updateMirror(context.Background(), m, *types.NewHTTPSRemote(remote), report, &log)
+			if types.ErrorClass(err) != tt.wantClass {
+				t.Fatalf("updateMirror() = %v, want class %q", err, tt.wantClass)
+			}
+			if report.Stale != tt.wantStale || report.Offline != tt.offline || (tt.wantStale && report.StaleError == "") {
+				t.Errorf("report stale = %v (%s), offline = %v", report.Stale, report.StaleError, report.Offline)
+			}
+			if err == nil && m.Action != types.MirrorReused {
+				t.Errorf("mirror action = %s", m.Action)
+			}
+			if strings.Contains(report.StaleError, "tok") {
+				t.Errorf("stale error has the token: %s", report.StaleError)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/scheduler"
+	"github.com/natemarks/cache_clone/server"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+// the daemon only serves when --listen is given. serve always does
+var daemonListen string
+
+// daemonCmd represents the daemon command
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Refresh the mirrors in the background",
+	Long: `Access the stash credentials from AWS Secret Manager.
+                     Fetch each mirror under the mirror root at an interval based on how often it is used.
+                     Use clone --max-age so clones don't fetch mirrors the daemon keeps fresh`,
+	Run: func(cmd *cobra.Command, args []string) {
+		log := config.GetLogger(settings)
+		exitOnError(runDaemon(&log), &log)
+	},
+}
+
+// runDaemon refreshes mirrors, and serves them with --listen, until it is interrupted
+func runDaemon(log *zerolog.Logger) error {
+	if err := types.CheckMirrorRoot(settings); err != nil {
+		return err
+	}
+	log.Debug().Msg("Getting credentials from AWS Secret Manager")
+	creds, err := types.LoadCredential(context.Background(), settings, log)
+	if err != nil {
+		return err
+	}
+	var webhookSecret string
+	if settings.WebhookSecretKey != "" {
+		if daemonListen == "" {
+			return errors.New("--webhookSecretKey requires --listen")
+		}
+		if webhookSecret, err = types.LoadSecretValue(settings, settings.WebhookSecretKey, log); err != nil {
+			return err
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sc := scheduler.New(settings, creds, log)
+	errs := make(chan error, 1)
+	if daemonListen != "" {
+		settings.Listen = daemonListen
+		// the scheduler keeps the mirrors fresh. serving only creates missing ones
+		settings.RefreshInterval = 0
+		mux := http.NewServeMux()
+		if webhookSecret != "" {
+			mux.Handle("/webhook", sc.WebhookHandler(webhookSecret))
+		}
+		mux.Handle("/", server.New(settings, creds, log).Handler())
+		srv := &http.Server{Addr: settings.Listen, Handler: mux}
+		go func() {
+			log.Info().Msgf("serving %s on http://%s", settings.Mirror, settings.Listen)
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				errs <- err
+				stop()
+			}
+		}()
+		defer func() {
+			shutdown, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			srv.Shutdown(shutdown)
+		}()
+	}
+	log.Info().Msgf("refreshing mirrors under %s", settings.Mirror)
+	sc.Run(ctx)
+	log.Info().Msg("shutting down")
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+
+	daemonCmd.Flags().StringVar(&daemonListen, "listen", "", "also serve the mirror root on this address like the serve command. example: 127.0.0.1:8080")
+	daemonCmd.Flags().StringSliceVar(&settings.AllowedHosts, "allow-host", nil, "remote hosts whose mirrors are refreshed, in addition to the --remote host")
+	daemonCmd.Flags().StringVar(&settings.UpstreamScheme, "upstream-scheme", server.DefaultUpstreamScheme, "scheme used to create mirrors on request with --listen")
+	daemonCmd.Flags().IntVar(&settings.RefreshConcurrency, "concurrency", scheduler.DefaultConcurrency, "most mirrors fetched at once")
+	daemonCmd.Flags().DurationVar(&settings.MinRefreshInterval, "min-interval", scheduler.DefaultMinInterval, "shortest time between refreshes of a busy mirror. also the first retry after a failure")
+	daemonCmd.Flags().DurationVar(&settings.MaxRefreshInterval, "max-interval", scheduler.DefaultMaxInterval, "time between refreshes of an unused mirror. also the longest retry backoff")
+	daemonCmd.Flags().DurationVar(&settings.BundleInterval, "bundle-interval", scheduler.DefaultBundleInterval, "upload a bundle of each refreshed mirror to --bundle-bucket at most this often. 0 disables uploads")
+	daemonCmd.Flags().IntVar(&settings.BundleKeep, "bundle-keep", scheduler.DefaultBundleKeep, "bundles kept for each remote. older ones are deleted")
+	daemonCmd.Flags().StringVar(&settings.WebhookSecretKey, "webhookSecretKey", "", "webhook secret key or dotted path (ex. git.webhook) in the secret JSON dict. enables POST /webhook with --listen")
+	daemonCmd.Flags().Float64Var(&settings.RefreshJitter, "jitter", scheduler.DefaultJitter, "fraction of the interval added or removed at random so mirrors don't refresh together")
+}
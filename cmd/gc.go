@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/metrics"
+	"github.com/natemarks/cache_clone/scheduler"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+// gcCmd represents the gc command
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Compact the mirrors and the fork network object stores",
+	Long: `Run git gc on each mirror under the mirror root. Mirrors of a fork network (--fork-network,
+                     or the same root commit with --detect-forks) join its shared object store first.
+                     Their refs are copied to the store before objects in it are removed from them,
+                     and the stores never drop objects, so no member loses an object it borrows`,
+	Run: func(cmd *cobra.Command, args []string) {
+		log := config.GetLogger(settings)
+		ctx, report, span := start("gc", &log)
+		err := runGC(ctx, &log)
+		finish(report, span, err, &log)
+	},
+}
+
+// runGC compacts every mirror, then every network object store, and records their size
+// A mirror that fails is logged and the rest are still compacted
+func runGC(ctx context.Context, log *zerolog.Logger) error {
+	if err := types.CheckMirrorRoot(settings); err != nil {
+		return err
+	}
+	perms, _ := config.ParsePermissions(settings)
+	paths, err := scheduler.FindMirrors(settings.Mirror)
+	if err != nil {
+		return &types.Error{Class: types.ErrorClassFilesystem, Msg: "unable to scan mirror root " + settings.Mirror, Err: err}
+	}
+	var failed error
+	for _, p := range paths {
+		m := &types.Mirror{Path: p, Perms: perms, DetectForks: settings.DetectForks, Root: settings.Mirror}
+		remoteURL := ""
+		if remote, err := m.Remote(ctx); err == nil {
+			remote = remote.Normalize(settings)
+			m.Network = types.ConfiguredNetwork(settings, *remote)
+			remoteURL = remote.URL.String()
+		}
+		if err = m.GC(ctx, log); err != nil {
+			log.Error().Err(err).Msgf("unable to gc %s", p)
+			failed = err
+			continue
+		}
+		metrics.ObserveMirrorSize(metrics.Default, remoteURL, p)
+		log.Info().Msgf("compacted %s", p)
+	}
+	stores, err := types.NetworkStores(settings.Mirror)
+	if err != nil {
+		return &types.Error{Class: types.ErrorClassFilesystem, Msg: "unable to scan network object stores", Err: err}
+	}
+	for _, store := range stores {
+		if err = types.GCNetwork(ctx, store); err != nil {
+			log.Error().Err(err).Msgf("unable to gc %s", store)
+			failed = err
+			continue
+		}
+		metrics.ObserveMirrorSize(metrics.Default, "", store)
+		log.Info().Msgf("compacted %s", store)
+	}
+	return failed
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+}
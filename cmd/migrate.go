@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"context"
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/metrics"
+	"github.com/natemarks/cache_clone/scheduler"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var migrateLink bool
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Move the mirrors of a path layout mirror root into the hashed layout",
+	Long: `Rename each <mirror>/<host>/<path> mirror to <mirror>/<sha256>.git and add it to
+                     <mirror>/cache_clone.index without cloning it again. Stop the clones, serve and
+                     daemon using the mirror root first, then run them with --mirror-layout hashed.
+                     Local clones of a moved mirror stop working unless --link leaves a symlink at
+                     its old path`,
+	Run: func(cmd *cobra.Command, args []string) {
+		log := config.GetLogger(settings)
+		ctx, report, span := start("migrate", &log)
+		err := runMigrate(ctx, &log)
+		finish(report, span, err, &log)
+	},
+}
+
+// runMigrate moves every mirror that isn't in the hashed layout yet
+// A mirror that can't be moved is logged and the rest are still moved
+func runMigrate(ctx context.Context, log *zerolog.Logger) error {
+	if err := types.CheckMirrorRoot(settings); err != nil {
+		return err
+	}
+	perms, _ := config.ParsePermissions(settings)
+	paths, err := scheduler.FindMirrors(settings.Mirror)
+	if err != nil {
+		return &types.Error{Class: types.ErrorClassFilesystem, Msg: "unable to scan mirror root " + settings.Mirror, Err: err}
+	}
+	var failed error
+	moved := 0
+	for _, p := range paths {
+		if types.IsHashed(settings.Mirror, p) {
+			continue
+		}
+		m := &types.Mirror{Path: p, Perms: perms}
+		target, err := m.MigrateToHashed(ctx, settings, migrateLink, log)
+		if err != nil {
+			log.Error().Err(err).Msgf("unable to migrate %s", p)
+			failed = err
+			continue
+		}
+		remoteURL := ""
+		if remote, err := m.Remote(ctx); err == nil {
+			remoteURL = remote.Normalize(settings).URL.String()
+		}
+		metrics.ObserveMirrorSize(metrics.Default, remoteURL, target)
+		log.Info().Msgf("migrated %s to %s", p, target)
+		if !migrateLink {
+			// local clones have the old path as their origin
+			log.Warn().Msgf("%s no longer exists. local clones of it fail to fetch until they run: git remote set-url origin %s. --link keeps the old path", p, target)
+		}
+		moved++
+	}
+	log.Info().Msgf("migrated %d of %d mirrors", moved, len(paths))
+	return failed
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().BoolVar(&migrateLink, "link", false, "leave a symlink at each old mirror path, so local clones of it keep working")
+}
@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"context"
 	"github.com/natemarks/cache_clone/config"
 	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
 
 	"github.com/spf13/cobra"
 )
@@ -16,15 +18,36 @@ var pushCmd = &cobra.Command{
                      Push the local mirror to the remote`,
 	Run: func(cmd *cobra.Command, args []string) {
 		log := config.GetLogger(settings)
-		//TODO: remove the next three lines. I don't think we need cred for push
-		//log.Debug().Msg("Getting credentials from AWS Secret Manager")
-		//r := types.NewHTTPSRemote(settings.Remote)
-		//creds := *types.NewCredential(settings, &log)
-		types.PushMirror(settings, &log)
-
+		ctx, report, span := start("push", &log)
+		err := runPush(ctx, report, &log)
+		finish(report, span, err, &log)
 	},
 }
 
+// runPush pushes the local refs through the mirror to the remote
+func runPush(ctx context.Context, report *types.Report, log *zerolog.Logger) error {
+	if _, err := parseRemote(); err != nil {
+		return err
+	}
+	report.MirrorPath = types.NewMirror(settings, log).Path
+	if err := types.CheckMirrorRoot(settings); err != nil {
+		return err
+	}
+	// the mirror remote URL has no credential. it is sent in a header
+	log.Debug().Msg("Getting credentials from AWS Secret Manager")
+	creds, err := types.LoadCredential(ctx, settings, log)
+	if err != nil {
+		return err
+	}
+	results, err := types.PushMirror(ctx, settings, creds, log)
+	report.RefResults = results
+	// a dry run has remote results for refs it didn't push
+	if !settings.DryRun {
+		report.PushedRefs = types.PushedRefs(results)
+	}
+	return err
+}
+
 func init() {
 	rootCmd.AddCommand(pushCmd)
 
@@ -37,4 +60,14 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// pushCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	pushCmd.Flags().StringVar(&settings.Report, "report", "", "write a JSON run report to this file")
+	pushCmd.Flags().StringSliceVar(&settings.ProtectedBranches, "protected-branch", nil, "branch pattern that can't be pushed. repeatable. example: --protected-branch main --protected-branch 'release/*'")
+	pushCmd.Flags().IntVar(&settings.MaxUnpushed, "max-unpushed", 0, "refuse to push more than this many commits. 0 for no limit")
+	pushCmd.Flags().BoolVar(&settings.RequireSigned, "require-signed", false, "refuse to push commits without a good signature")
+	pushCmd.Flags().BoolVar(&settings.DryRun, "dry-run", false, "show what would be pushed to the mirror and the remote without pushing. remote hooks don't run")
+	pushCmd.Flags().StringArrayVar(&settings.Refspecs, "refspec", nil, "refspec to push instead of the current branch. repeatable. example: refs/heads/a:refs/heads/a")
+	pushCmd.Flags().BoolVar(&settings.PushTags, "tags", false, "push all local tags")
+	pushCmd.Flags().BoolVar(&settings.AllBranches, "all-branches", false, "push all local branches")
+	pushCmd.Flags().BoolVar(&settings.WriteThrough, "write-through", false, "push to the remote first and update the mirror only with the refs the remote accepted")
+	pushCmd.Flags().BoolVar(&settings.RebaseOnReject, "rebase-on-reject", false, "after a non-fast-forward rejection, rebase the current branch onto the remote branch and push again")
 }
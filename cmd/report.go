@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"context"
+	"os"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/metrics"
+	"github.com/natemarks/cache_clone/tracing"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/natemarks/cache_clone/version"
+	"github.com/rs/zerolog"
+)
+
+// start begins the run report and the root tracing span for a command
+// The returned context carries the span for the spans of the run
+func start(command string, log *zerolog.Logger) (context.Context, *types.Report, *tracing.Span) {
+	err := tracing.Init(tracing.Config{
+		Endpoint:       settings.OTLPEndpoint,
+		File:           settings.TraceFile,
+		ServiceVersion: version.Version,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("tracing disabled")
+	}
+	ctx, span := tracing.Start(context.Background(), "cache_clone "+command)
+	// the remote can carry a token in its userinfo
+	span.SetAttribute("git.remote", config.Redact(settings.Remote))
+	return ctx, types.NewReport(command, settings), span
+}
+
+// finish writes the run report, metrics and spans if they were requested and exits on error
+// The exit code depends on the error class
+func finish(report *types.Report, span *tracing.Span, err error, log *zerolog.Logger) {
+	report.Finish(err)
+	if settings.Report != "" {
+		log.Debug().Msgf("writing run report: %s", settings.Report)
+		if werr := report.Write(settings.Report); werr != nil {
+			log.Error().Err(werr).Msgf("unable to write run report: %s", settings.Report)
+		}
+	}
+	if settings.MetricsFile != "" {
+		log.Debug().Msgf("writing metrics: %s", settings.MetricsFile)
+		metrics.ObserveReport(metrics.Default, *report)
+		if werr := metrics.Default.WriteTextfile(settings.MetricsFile); werr != nil {
+			log.Error().Err(werr).Msgf("unable to write metrics: %s", settings.MetricsFile)
+		}
+	}
+	span.SetAttribute("mirror.path", report.MirrorPath)
+	span.SetAttribute("error.class", report.ErrorClass)
+	span.Finish(err)
+	if werr := tracing.Shutdown(); werr != nil {
+		log.Error().Err(werr).Msg("unable to export tracing spans")
+	}
+	exitOnError(err, log)
+}
+
+// exitOnError logs a fatal error and exits with its exit code
+// The exit code tells a pipeline why the run failed without parsing the log
+func exitOnError(err error, log *zerolog.Logger) {
+	if err != nil {
+		log.WithLevel(zerolog.FatalLevel).Err(err).Str("errorClass", types.ErrorClass(err)).Msg(err.Error())
+		os.Exit(types.ExitCode(err))
+	}
+}
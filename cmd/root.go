@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/types"
 	"github.com/spf13/cobra"
 )
 
@@ -47,6 +48,12 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&settings.Mirror, "mirror", "m", "", "Root location for all mirror repos")
 	rootCmd.MarkFlagRequired("mirror")
 
+	rootCmd.PersistentFlags().StringVar(&settings.DirMode, "dir-mode", config.DefaultDirMode, "octal mode for directories created under the mirror root")
+
+	rootCmd.PersistentFlags().StringVar(&settings.FileMode, "file-mode", config.DefaultFileMode, "octal mode for mirror files. example: 0664 for a shared group")
+
+	rootCmd.PersistentFlags().StringVar(&settings.MirrorGroup, "mirror-group", "", "group (name or id) that owns the mirror root so several build users can share it")
+
 	rootCmd.PersistentFlags().StringVarP(&settings.Local, "local", "l", "", "Location to create the repo clone")
 	rootCmd.MarkFlagRequired("local")
 
@@ -56,10 +63,62 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&settings.SecretID, "secretID", "s", "", "AWS Secret Manager secretID path")
 	rootCmd.MarkFlagRequired("secretID")
 
-	rootCmd.PersistentFlags().StringVarP(&settings.UserKey, "userKey", "u", "", "username key in the secret JSON dict")
+	rootCmd.PersistentFlags().StringVarP(&settings.UserKey, "userKey", "u", "", "username key or dotted path (ex. git.user) in the secret JSON dict")
 	rootCmd.MarkFlagRequired("userKey")
 
-	rootCmd.PersistentFlags().StringVarP(&settings.TokenKey, "tokenKey", "t", "", "token key in the secret JSON dict")
+	rootCmd.PersistentFlags().StringVarP(&settings.TokenKey, "tokenKey", "t", "", "token key or dotted path (ex. git.token) in the secret JSON dict")
 	rootCmd.MarkFlagRequired("tokenKey")
 
+	rootCmd.PersistentFlags().StringVar(&settings.SecretUsername, "secretUsername", "", "fixed remote username. overrides userKey. token only secrets default to x-access-token")
+
+	rootCmd.PersistentFlags().StringVar(&settings.SecretVersionStage, "secretVersionStage", "", "AWS Secret Manager version stage. default: AWSCURRENT")
+
+	rootCmd.PersistentFlags().StringVar(&settings.SecretVersionID, "secretVersionId", "", "AWS Secret Manager version id")
+
+	rootCmd.PersistentFlags().StringVar(&settings.AWSRegion, "aws-region", "", "AWS region. default: from the environment/shared config")
+
+	rootCmd.PersistentFlags().StringVar(&settings.AWSProfile, "aws-profile", "", "AWS shared config profile")
+
+	rootCmd.PersistentFlags().StringVar(&settings.AWSRoleARN, "aws-role-arn", "", "AWS IAM role to assume before reading the secret")
+
+	rootCmd.PersistentFlags().StringVar(&settings.AWSExternalID, "aws-external-id", "", "external ID for the assumed role")
+
+	rootCmd.PersistentFlags().StringVar(&settings.AWSSessionName, "aws-session-name", "", "session name for the assumed role")
+
+	rootCmd.PersistentFlags().StringVar(&settings.AWSEndpointURL, "aws-endpoint-url", "", "custom AWS Secret Manager endpoint URL. example: http://localhost:4566")
+
+	rootCmd.PersistentFlags().StringToStringVar(&settings.HostAliases, "host-alias", nil, "other name of a git server, so its URLs share mirrors with the canonical name. example: git.corp=stash.corp.example.com")
+
+	rootCmd.PersistentFlags().StringSliceVar(&settings.BitbucketHosts, "bitbucket-host", nil, "Bitbucket Server host. its /projects/PROJ/repos/repo web URLs share the mirror of the /scm/proj/repo.git clone URL")
+
+	rootCmd.PersistentFlags().StringVar(&settings.MirrorLayout, "mirror-layout", types.LayoutPath, "mirror directory layout. path: <mirror>/<host>/<path>. hashed: <mirror>/<sha256>.git, named in <mirror>/cache_clone.index")
+
+	rootCmd.PersistentFlags().StringToStringVar(&settings.ForkNetworks, "fork-network", nil, "fork network of a remote. mirrors of one network share an object store. example: https://host/bob/app.git=app")
+
+	rootCmd.PersistentFlags().BoolVar(&settings.DetectForks, "detect-forks", false, "new mirrors of remotes without --fork-network share an object store with the mirrors of the same root commit")
+
+	rootCmd.PersistentFlags().StringVar(&settings.BundleBucket, "bundle-bucket", "", "S3-compatible bucket of mirror bundles. new mirrors start from the newest bundle, then fetch the rest from the remote")
+
+	rootCmd.PersistentFlags().StringVar(&settings.BundlePrefix, "bundle-prefix", "", "key prefix of the mirror bundles in --bundle-bucket")
+
+	rootCmd.PersistentFlags().StringVar(&settings.BundleEndpointURL, "bundle-endpoint-url", "", "S3-compatible endpoint of --bundle-bucket. default: AWS S3 in the region. example: http://localhost:9000")
+
+	rootCmd.PersistentFlags().StringVar(&settings.CredentialType, "credentialType", types.BasicCredential, "basic (username/token), bearer (Authorization header) or github-app")
+
+	rootCmd.PersistentFlags().StringVar(&settings.ExpiryKey, "expiryKey", "", "RFC3339 bearer token expiry key in the secret JSON dict")
+
+	rootCmd.PersistentFlags().StringVar(&settings.AppIDKey, "appIDKey", "app_id", "GitHub App id key in the secret JSON dict")
+
+	rootCmd.PersistentFlags().StringVar(&settings.InstallationIDKey, "installationIDKey", "installation_id", "GitHub App installation id key in the secret JSON dict")
+
+	rootCmd.PersistentFlags().StringVar(&settings.PrivateKeyKey, "privateKeyKey", "private_key", "GitHub App PEM private key key in the secret JSON dict")
+
+	rootCmd.PersistentFlags().StringVar(&settings.GitHubAPIURL, "githubAPIURL", types.DefaultGitHubAPIURL, "GitHub API base URL. GitHub Enterprise: https://<host>/api/v3")
+
+	rootCmd.PersistentFlags().StringVar(&settings.MetricsFile, "metrics-file", "", "node_exporter textfile collector file to update with cache metrics. example: /var/lib/node_exporter/cache_clone.prom")
+
+	rootCmd.PersistentFlags().StringVar(&settings.OTLPEndpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector for tracing spans. example: http://localhost:4318")
+
+	rootCmd.PersistentFlags().StringVar(&settings.TraceFile, "trace-file", "", "write tracing spans to this file as OTLP JSON")
+
 }
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/server"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve the mirror root as a read-only git smart-HTTP endpoint",
+	Long: `Serve every mirror under the mirror root over HTTP.
+                     Clone with: git clone http://<listen>/<remote host>/<remote path>
+                     Missing mirrors of allowed hosts are created on the first request`,
+	Run: func(cmd *cobra.Command, args []string) {
+		log := config.GetLogger(settings)
+		exitOnError(runServe(&log), &log)
+	},
+}
+
+// runServe serves the mirror root until it is interrupted
+func runServe(log *zerolog.Logger) error {
+	if err := types.CheckMirrorRoot(settings); err != nil {
+		return err
+	}
+	// without a secret only existing mirrors are served
+	var creds *types.Credential
+	if settings.SecretID != "" {
+		log.Debug().Msg("Getting credentials from AWS Secret Manager")
+		var err error
+		if creds, err = types.LoadCredential(context.Background(), settings, log); err != nil {
+			return err
+		}
+	} else {
+		log.Warn().Msg("no --secretID. serving existing mirrors without refreshing them")
+	}
+
+	srv := &http.Server{Addr: settings.Listen, Handler: server.New(settings, creds, log).Handler()}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		log.Info().Msg("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+	log.Info().Msgf("serving %s on http://%s", settings.Mirror, settings.Listen)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().StringVar(&settings.Listen, "listen", server.DefaultListen, "address to serve on. use 0.0.0.0:8080 to serve the LAN")
+	serveCmd.Flags().StringSliceVar(&settings.AllowedHosts, "allow-host", nil, "remote hosts whose mirrors can be created on request, in addition to the --remote host")
+	serveCmd.Flags().StringVar(&settings.UpstreamScheme, "upstream-scheme", server.DefaultUpstreamScheme, "scheme used to create and refresh mirrors")
+	serveCmd.Flags().DurationVar(&settings.RefreshInterval, "refresh-interval", 5*time.Minute, "fetch a mirror on request when it is older than this. 0 never fetches")
+	serveCmd.Flags().BoolVar(&settings.CheckUpstream, "check-upstream", false, "compare the mirror with the remote refs before each clone and fetch if they differ")
+	serveCmd.Flags().BoolVar(&settings.ForwardPush, "forward-push", false, "forward pushes to the remote with the credential. anyone who can reach --listen can push")
+}
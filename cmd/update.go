@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"context"
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+var hardReset bool
+
+// updateCmd represents the update command
+var updateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Bring an existing local repo up to date through its mirror",
+	Long: `Access the stash credentials from AWS Secret Manager.
+                     Update the mirror the local repo was cloned from.
+                     Fast-forward (or reset) the current branch from the mirror`,
+	Run: func(cmd *cobra.Command, args []string) {
+		log := config.GetLogger(settings)
+		ctx, report, span := start("update", &log)
+		err := runUpdate(ctx, report, &log)
+		finish(report, span, err, &log)
+	},
+}
+
+// runUpdate refreshes the mirror of the local repo and updates the current branch
+func runUpdate(ctx context.Context, report *types.Report, log *zerolog.Logger) error {
+	m, remote, err := types.LocalMirror(ctx, settings.Local, settings)
+	if err != nil {
+		return err
+	}
+	report.MirrorPath = m.Path
+	// an explicit remote wins over the one saved in the mirror
+	if settings.Remote != "" {
+		if remote, err = types.NewRemote(settings.Remote); err != nil {
+			return err
+		}
+		remote = remote.Stripped()
+	}
+	log.Debug().Msg("Getting credentials from AWS Secret Manager")
+	creds, err := types.LoadCredential(ctx, settings, log)
+	if err != nil {
+		return err
+	}
+	err = m.UpdateClone(ctx, *remote, *creds, log)
+	report.SetMirror(m)
+	if err != nil {
+		return err
+	}
+	if err = m.RecordAccess(); err != nil {
+		log.Warn().Err(err).Msgf("unable to record access to %s", m.Path)
+	}
+	if err = m.UpdateLocal(ctx, settings.Local, hardReset, log); err != nil {
+		return err
+	}
+	report.CommitSHA, err = types.HeadCommit(ctx, settings.Local)
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(updateCmd)
+
+	updateCmd.Flags().BoolVar(&hardReset, "hard-reset", false, "reset the current branch to the mirror instead of fast-forwarding")
+	updateCmd.Flags().StringVar(&settings.Report, "report", "", "write a JSON run report to this file")
+}
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+)
+
+// TestRunUpdate fetches a new upstream commit through the mirror into a local clone
+func TestRunUpdate(t *testing.T) {
+	repos, work := t.TempDir(), t.TempDir()
+	upstream := filepath.Join(repos, "org", "repo.git")
+	gitRun := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("git", append([]string{"-c", "user.name=a", "-c", "user.email=a@b"}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	gitRun("init", "-q", "-b", "main", work)
+	gitRun("-C", work, "commit", "-q", "--allow-empty", "-m", "one")
+	gitRun("clone", "-q", "--bare", work, upstream)
+
+	saved := settings
+	defer func() { settings = saved }()
+	settings = config.Settings{
+		Mirror:         t.TempDir(),
+		Local:          filepath.Join(t.TempDir(), "local"),
+		Remote:         gitServer(t, repos).URL + "/org/repo.git",
+		SecretID:       "x",
+		UserKey:        "user",
+		TokenKey:       "token",
+		AWSRegion:      "us-east-1",
+		AWSEndpointURL: secretsServer(t).URL,
+	}
+	log := zerolog.Nop()
+	if err := runClone(context.Background(), types.NewReport("clone", settings), &log); err != nil {
+		t.Fatal(err)
+	}
+	gitRun("-C", work, "commit", "-q", "--allow-empty", "-m", "two")
+	gitRun("-C", work, "push", "-q", upstream, "main")
+
+	// update finds the mirror and remote from the local clone
+	settings.Remote = ""
+	report := types.NewReport("update", settings)
+	if err := runUpdate(context.Background(), report, &log); err != nil {
+		t.Fatal(err)
+	}
+	if want := gitRun("-C", upstream, "rev-parse", "main"); report.CommitSHA != want {
+		t.Errorf("local HEAD = %s, want %s", report.CommitSHA, want)
+	}
+}
@@ -0,0 +1,216 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Default modes for mirror directories and files
+const (
+	DefaultDirMode  = "0755"
+	DefaultFileMode = "0644"
+)
+
+// accessWriteSearch is W_OK|X_OK for access(2)
+const accessWriteSearch = 0x2 | 0x1
+
+// Permissions are the modes and group applied to everything created under the mirror root
+type Permissions struct {
+	DirMode  os.FileMode
+	FileMode os.FileMode
+	// group id for new directories. -1 to keep the default group
+	GID   int
+	Group string
+}
+
+// ParsePermissions parses the octal modes and the group (name or id) in the settings
+func ParsePermissions(s Settings) (Permissions, error) {
+	p := Permissions{GID: -1, Group: s.MirrorGroup}
+	dirMode, fileMode := s.DirMode, s.FileMode
+	if dirMode == "" {
+		dirMode = DefaultDirMode
+	}
+	if fileMode == "" {
+		fileMode = DefaultFileMode
+	}
+	mode, err := strconv.ParseUint(dirMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return p, fmt.Errorf("invalid directory mode %s: use octal like 0775", dirMode)
+	}
+	p.DirMode = os.FileMode(mode)
+	if mode, err = strconv.ParseUint(fileMode, 8, 32); err != nil || mode > 0777 {
+		return p, fmt.Errorf("invalid file mode %s: use octal like 0664", fileMode)
+	}
+	p.FileMode = os.FileMode(mode)
+	if s.MirrorGroup == "" {
+		return p, nil
+	}
+	if p.GID, err = strconv.Atoi(s.MirrorGroup); err == nil {
+		return p, nil
+	}
+	g, err := user.LookupGroup(s.MirrorGroup)
+	if err != nil {
+		return p, fmt.Errorf("unknown mirror group %s: %w", s.MirrorGroup, err)
+	}
+	p.GID, _ = strconv.Atoi(g.Gid)
+	return p, nil
+}
+
+// SharedRepository returns the git core.sharedRepository value for the file mode
+// empty if the default git behavior is fine
+func (p Permissions) SharedRepository() string {
+	if p.GID < 0 && p.FileMode.Perm() == 0644 {
+		return ""
+	}
+	return fmt.Sprintf("0%o", p.FileMode.Perm())
+}
+
+// MkdirAll creates dir and any missing parents with the directory mode and group
+// The mode is set explicitly so it doesn't depend on the umask. With a group the
+// directories are setgid so everything created in them inherits the group
+func (p Permissions) MkdirAll(dir string) error {
+	var missing []string
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		info, err := os.Stat(d)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s exists and is not a directory", d)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	mode := p.DirMode
+	if p.GID >= 0 {
+		mode |= os.ModeSetgid
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		d := missing[i]
+		if err := os.Mkdir(d, p.DirMode); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if p.GID >= 0 {
+			if err := os.Chown(d, -1, p.GID); err != nil {
+				return fmt.Errorf("unable to set group %s on %s: %w", p.Group, d, err)
+			}
+		}
+		if err := os.Chmod(d, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChmodTree applies the modes and group to an existing tree
+// git creates the initial files of a clone with the umask, before it reads core.sharedRepository
+func (p Permissions) ChmodTree(root string) error {
+	dirMode := p.DirMode
+	if p.GID >= 0 {
+		dirMode |= os.ModeSetgid
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p.GID >= 0 {
+			if err = os.Lchown(path, -1, p.GID); err != nil {
+				return err
+			}
+		}
+		switch {
+		case info.IsDir():
+			return os.Chmod(path, dirMode)
+		case info.Mode().IsRegular():
+			// git keeps objects and packs read only
+			mode := p.FileMode
+			if info.Mode().Perm()&0200 == 0 {
+				mode &^= 0222
+			}
+			return os.Chmod(path, mode)
+		}
+		return nil
+	})
+}
+
+// CheckWritable returns an actionable error if dir can't be created or written
+// by the current user, or if the user isn't in the group
+func (p Permissions) CheckWritable(dir string) error {
+	existing := filepath.Clean(dir)
+	for {
+		if _, err := os.Stat(existing); err == nil || filepath.Dir(existing) == existing {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	info, err := os.Stat(existing)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", existing)
+	}
+	if syscall.Access(existing, accessWriteSearch) != nil {
+		return fmt.Errorf("%s is not writable by %s (%s). fix the permissions or use a different --mirror",
+			existing, currentUser(), describe(info))
+	}
+	if p.GID < 0 {
+		return nil
+	}
+	if !inGroup(p.GID) {
+		return fmt.Errorf("%s is not in group %s. add the user to the group or drop --mirror-group", currentUser(), p.Group)
+	}
+	if existing == filepath.Clean(dir) {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Gid) != p.GID {
+			return fmt.Errorf("%s (%s) is not in group %s. run: chgrp -R %s %s && chmod -R g+rwX %s && find %s -type d -exec chmod g+s {} +",
+				dir, describe(info), p.Group, p.Group, dir, dir, dir)
+		}
+	}
+	return nil
+}
+
+// inGroup returns true if the process has gid as its primary or a supplementary group
+func inGroup(gid int) bool {
+	if os.Getegid() == gid {
+		return true
+	}
+	groups, _ := os.Getgroups()
+	for _, g := range groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// describe returns the owner, group and mode of a file for error messages
+func describe(info os.FileInfo) string {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.Mode().String()
+	}
+	owner, group := strconv.Itoa(int(st.Uid)), strconv.Itoa(int(st.Gid))
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+	return fmt.Sprintf("owner %s group %s mode %s", owner, group, info.Mode())
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return fmt.Sprintf("user %s (uid %s)", u.Username, u.Uid)
+	}
+	return fmt.Sprintf("uid %d", os.Geteuid())
+}
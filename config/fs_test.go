@@ -0,0 +1,55 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestMkdirAll checks the directory mode is applied regardless of the umask
+func TestMkdirAll(t *testing.T) {
+	old := syscall.Umask(077)
+	defer syscall.Umask(old)
+
+	p, err := ParsePermissions(Settings{DirMode: "0775", FileMode: "0664", MirrorGroup: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.SharedRepository() != "0664" {
+		t.Errorf("SharedRepository() = %s", p.SharedRepository())
+	}
+	root := t.TempDir()
+	dir := filepath.Join(root, "a", "b")
+	if err := p.CheckWritable(dir); err != nil && os.Getegid() == 0 {
+		t.Fatal(err)
+	}
+	if os.Getegid() != 0 {
+		// only root can use group 0 in this test
+		p.GID = -1
+	}
+	if err := p.MkdirAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{filepath.Join(root, "a"), dir} {
+		info, err := os.Stat(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0775 {
+			t.Errorf("%s mode = %s, want 0775", d, info.Mode())
+		}
+		if p.GID >= 0 && info.Mode()&os.ModeSetgid == 0 {
+			t.Errorf("%s should be setgid", d)
+		}
+	}
+}
+
+// TestParsePermissionsInvalid rejects modes that aren't octal permissions
+func TestParsePermissionsInvalid(t *testing.T) {
+	for _, s := range []Settings{{DirMode: "999"}, {FileMode: "17777"}, {MirrorGroup: "no-such-group-cache-clone"}} {
+		if _, err := ParsePermissions(s); err == nil {
+			t.Errorf("ParsePermissions(%+v) should fail", s)
+		}
+	}
+}
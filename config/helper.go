@@ -3,14 +3,19 @@ package config
 // helper functions
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/rs/zerolog/log"
+	zlog "github.com/rs/zerolog/log"
 
+	"github.com/natemarks/cache_clone/tracing"
 	"github.com/natemarks/cache_clone/version"
 	"github.com/rs/zerolog"
 )
@@ -24,18 +29,114 @@ type Settings struct {
 	Mirror   string
 	Local    string
 	Remote   string
+	// fixed username for plaintext (token only) secrets. overrides UserKey
+	SecretUsername string
+	// select a secret version other than AWSCURRENT
+	SecretVersionStage string
+	SecretVersionID    string
+	// AWS options. empty values use the SDK default chain
+	AWSRegion      string
+	AWSProfile     string
+	AWSRoleARN     string
+	AWSExternalID  string
+	AWSSessionName string
+	// custom Secrets Manager endpoint. useful for testing against a local stand-in
+	AWSEndpointURL string
+	// basic, bearer or github-app
+	CredentialType string
+	// RFC3339 expiry of a bearer token in the secret. empty if it doesn't expire
+	ExpiryKey string
+	// GitHub App secret keys and API base URL
+	AppIDKey          string
+	InstallationIDKey string
+	PrivateKeyKey     string
+	GitHubAPIURL      string
+	// JSON run report file. empty for no report
+	Report string
+	// node_exporter textfile collector file. empty for no metrics
+	MetricsFile string
+	// OTLP/HTTP endpoint and local file for tracing spans. both empty disables tracing
+	OTLPEndpoint string
+	TraceFile    string
+	// octal modes and group (name or id) for everything created under the mirror root
+	DirMode     string
+	FileMode    string
+	MirrorGroup string
+	// branch, tag or commit to check out. empty for the mirror default branch
+	Ref string
+	// push safety checks. branch patterns use path.Match syntax
+	ProtectedBranches []string
+	MaxUnpushed       int
+	RequireSigned     bool
+	DryRun            bool
+	// refs to push instead of the current branch
+	Refspecs    []string
+	PushTags    bool
+	AllBranches bool
+	// push to the remote first and only then update the mirror
+	WriteThrough bool
+	// rebase the current branch onto the remote and push again after a non-fast-forward rejection
+	RebaseOnReject bool
+	// serve address, hosts whose mirrors can be created on request and the
+	// scheme used to reach them. a mirror older than RefreshInterval is fetched
+	Listen          string
+	AllowedHosts    []string
+	UpstreamScheme  string
+	RefreshInterval time.Duration
+	// compare the mirror with the remote refs before each clone it serves
+	CheckUpstream bool
+	// forward pushes to the remote with the credential
+	ForwardPush bool
+	// clone doesn't fetch a mirror fetched less than MaxAge ago. 0 always fetches
+	MaxAge time.Duration
+	// alias host -> canonical host, for git servers known under several names
+	HostAliases map[string]string
+	// Bitbucket Server hosts. their web URLs share the mirror of the /scm/ clone URL
+	BitbucketHosts []string
+	// path or hashed. hashed names mirror directories by a hash of the remote URL
+	MirrorLayout string
+	// remote -> fork network. mirrors of one network share an object store. with
+	// DetectForks mirrors of remotes not listed join the network of their root commit
+	ForkNetworks map[string]string
+	DetectForks  bool
+	// clone never contacts the remote, or uses the existing mirror when the remote can't be reached
+	Offline    bool
+	AllowStale bool
+	// background refresh limits. the interval between refreshes follows the access rate
+	RefreshConcurrency int
+	MinRefreshInterval time.Duration
+	MaxRefreshInterval time.Duration
+	RefreshJitter      float64
+	// S3-compatible bucket, key prefix and endpoint of the mirror bundle store.
+	// new mirrors start from the newest bundle. an empty bucket disables it
+	BundleBucket      string
+	BundlePrefix      string
+	BundleEndpointURL string
+	// the daemon uploads a bundle of each mirror every BundleInterval and keeps BundleKeep of them
+	BundleInterval time.Duration
+	BundleKeep     int
+	// key or dotted path of the push webhook secret in the secret JSON dict
+	WebhookSecretKey string
 }
 
 // GetLogger returns a logger for the application
+// Every line is redacted before it is written
 func GetLogger(s Settings) (log zerolog.Logger) {
-	log = zerolog.New(os.Stdout).With().Str("version", version.Version).Timestamp().Logger()
+	// the global logger is used by Run
+	zlog.Logger = zlog.Output(RedactWriter{os.Stderr})
+	return NewLogger(RedactWriter{os.Stdout}, s)
+}
+
+// NewLogger returns a logger that writes to w
+func NewLogger(w io.Writer, s Settings) (log zerolog.Logger) {
+	log = zerolog.New(w).With().Str("version", version.Version).Timestamp().Logger()
 	log = log.Level(zerolog.InfoLevel)
-	log = log.With().Str("SecretID", s.SecretID).Logger()
 	log = log.With().Str("mirror", s.Mirror).Logger()
 	log = log.With().Str("local", s.Local).Logger()
 	log = log.With().Str("remote", s.Remote).Logger()
 	if s.Verbose {
 		log = log.Level(zerolog.DebugLevel)
+		log = log.With().Str("SecretID", s.SecretID).Logger()
 		log = log.With().Str("userKey", s.UserKey).Logger()
 		log = log.With().Str("tokenKey", s.TokenKey).Logger()
 		log.Debug().Msg("debug logging enabled")
@@ -48,6 +149,21 @@ func JoinPaths(elements ...string) string {
 	return filepath.Join(elements...)
 }
 
+// DirSize returns the total size of the regular files under a directory
+func DirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
 // Sha256sum return sh256sum of a string
 func Sha256sum(s string) string {
 	sum := sha256.Sum256([]byte(s))
@@ -61,30 +177,70 @@ type Result struct {
 	StdErr     string
 }
 
-// String returns a string representation of the result
+// String returns a redacted string representation of the result
 func (r Result) String() string {
-	return fmt.Sprintf("Return Code: %d StdOut: %s StdErr: %s", r.ReturnCode, r.StdOut, r.StdErr)
+	return Redact(fmt.Sprintf("Return Code: %d StdOut: %s StdErr: %s", r.ReturnCode, r.StdOut, r.StdErr))
+}
+
+// commandName returns the command and git subcommand for naming spans. ex. git fetch
+func commandName(c []string) string {
+	if len(c) == 0 || filepath.Base(c[0]) != "git" {
+		return strings.Join(c[:1], "")
+	}
+	for i := 1; i < len(c); i++ {
+		switch {
+		case c[i] == "-C" || c[i] == "-c":
+			i++
+		case !strings.HasPrefix(c[i], "-"):
+			return "git " + c[i]
+		}
+	}
+	return "git"
 }
 
 // Run Runs a shell command and waits to return the results
-func Run(c []string) (result Result, err error) {
+// Each command is a tracing span with its arguments, exit code and duration, under
+// the span in ctx. ctx doesn't cancel the command
+func Run(ctx context.Context, c []string) (result Result, err error) {
+	return RunEnv(ctx, nil, c)
+}
+
+// RunEnv runs a command like Run with extra environment variables
+// Secrets go here instead of the arguments, which other local users can read.
+// The variables aren't in the tracing span
+func RunEnv(ctx context.Context, env []string, c []string) (result Result, err error) {
+	_, span := tracing.Start(ctx, commandName(c))
+	start := time.Now()
+	defer func() {
+		args := make([]string, 0, len(c))
+		for _, arg := range c {
+			args = append(args, Redact(arg))
+		}
+		span.SetAttribute("process.command_args", args)
+		span.SetAttribute("process.exit_code", result.ReturnCode)
+		span.SetAttribute("process.duration_seconds", time.Since(start).Seconds())
+		span.Finish(err)
+	}()
 	var args []string
 	baseCommand := c[0]
 	args = append(args, c[1:]...)
 	cmd := exec.Command(baseCommand, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	outPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Error().Err(err).Msg("Error creating stdout pipe")
+		zlog.Error().Err(err).Msg("Error creating stdout pipe")
 		return Result{}, err
 	}
 	errPipe, err := cmd.StderrPipe()
 	if err != nil {
-		log.Error().Err(err).Msg("Error creating stderr pipe")
+		zlog.Error().Err(err).Msg("Error creating stderr pipe")
 		return Result{}, err
 	}
 	err = cmd.Start()
 	if err != nil {
-		log.Error().Err(err).Msg("Error starting command")
+		zlog.Error().Err(err).Msg("Error starting command")
 		return Result{}, err
 	}
 	oBuf := new(bytes.Buffer)
@@ -102,6 +258,6 @@ func Run(c []string) (result Result, err error) {
 	stderr := eBuf.String()
 
 	err = cmd.Wait()
-	return Result{cmd.ProcessState.ExitCode(), stdout, stderr}, err
+	return Result{cmd.ProcessState.ExitCode(), stdout, stderr}, RedactError(err)
 
 }
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestRedactLogger fails if a credential string reaches the logger
+func TestRedactLogger(t *testing.T) {
+	token := `s3cr3t/t0k:n"`
+	AddSecret(token)
+
+	buf := new(bytes.Buffer)
+	log := NewLogger(RedactWriter{buf}, Settings{Verbose: true})
+
+	u, _ := url.Parse("https://github.com/natemarks/cache_clone.git")
+	u.User = url.UserPassword("bob", token)
+	result := Result{
+		ReturnCode: 128,
+		StdErr:     fmt.Sprintf("fatal: unable to access '%s'", u.String()),
+	}
+	log.Info().Msg(token)
+	log.Info().Msgf("cloning %s", u.String())
+	log.Error().Err(errors.New("push failed: " + token)).Msg(result.String())
+	log.Debug().Str("header", "Authorization: Bearer "+token).Msg("header")
+	log.Debug().Msg("Authorization: Basic Ym9iOnBhc3N3b3Jk")
+
+	escaped := url.UserPassword("x", token).String()[2:]
+	for _, leak := range []string{token, `s3cr3t/t0k:n\"`, escaped, "bob:", "Ym9iOnBhc3N3b3Jk"} {
+		if strings.Contains(buf.String(), leak) {
+			t.Errorf("credential %q reached the logger:\n%s", leak, buf.String())
+		}
+	}
+	if !strings.Contains(buf.String(), "https://***@github.com") {
+		t.Errorf("remote URL host should still be logged:\n%s", buf.String())
+	}
+}
+
+// TestRedactError checks errors are only replaced when they contain a secret
+func TestRedactError(t *testing.T) {
+	AddSecret("an0ther-t0ken")
+	plain := errors.New("exit status 128")
+	if RedactError(plain) != plain {
+		t.Errorf("error without secrets should be unchanged")
+	}
+	if got := RedactError(errors.New("bad an0ther-t0ken")).Error(); got != "bad "+Redacted {
+		t.Errorf("RedactError() = %s", got)
+	}
+}
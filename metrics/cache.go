@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/types"
+)
+
+// Mirror cache metric names
+const (
+	RunsTotal         = "cache_clone_runs_total"
+	RunDuration       = "cache_clone_run_duration_seconds"
+	CacheHitsTotal    = "cache_clone_cache_hits_total"
+	CacheMissesTotal  = "cache_clone_cache_misses_total"
+	FetchDuration     = "cache_clone_fetch_duration_seconds"
+	FetchBytesTotal   = "cache_clone_fetch_bytes_total"
+	MirrorBytes       = "cache_clone_mirror_bytes"
+	AuthFailuresTotal = "cache_clone_auth_failures_total"
+)
+
+// RegisterCacheMetrics declares the mirror cache metrics
+func RegisterCacheMetrics(r *Registry) {
+	r.Register(RunsTotal, Counter, "cache_clone command runs by result and error class")
+	r.Register(RunDuration, Histogram, "cache_clone command duration")
+	r.Register(CacheHitsTotal, Counter, "runs that found an existing mirror")
+	r.Register(CacheMissesTotal, Counter, "runs that had to create the mirror")
+	r.Register(FetchDuration, Histogram, "duration of mirror clones and fetches from the remote")
+	r.Register(FetchBytesTotal, Counter, "bytes received from the remote")
+	r.Register(MirrorBytes, Gauge, "size of the mirror on disk")
+	r.Register(AuthFailuresTotal, Counter, "runs that failed to authenticate with the remote or secret store")
+}
+
+func init() {
+	RegisterCacheMetrics(Default)
+}
+
+// ObserveReport records the metrics for a finished run
+func ObserveReport(r *Registry, report types.Report) {
+	result := "success"
+	if !report.Success {
+		result = "failure"
+	}
+	r.Add(RunsTotal, Labels{"command": report.Command, "result": result, "error_class": report.ErrorClass}, 1)
+	r.Observe(RunDuration, Labels{"command": report.Command}, report.DurationSeconds)
+	if report.ErrorClass == types.ErrorClassAuth || report.ErrorClass == types.ErrorClassCredential {
+		r.Add(AuthFailuresTotal, Labels{"remote": report.Remote, "error_class": report.ErrorClass}, 1)
+	}
+
+	remote := Labels{"remote": report.Remote}
+	switch report.MirrorAction {
+	case types.MirrorCreated:
+		r.Add(CacheMissesTotal, remote, 1)
+	case types.MirrorUpdated, types.MirrorReused:
+		r.Add(CacheHitsTotal, remote, 1)
+	}
+	if report.MirrorAction != "" {
+		r.Observe(FetchDuration, Labels{"remote": report.Remote, "action": report.MirrorAction}, report.FetchDurationSeconds)
+		r.Add(FetchBytesTotal, remote, float64(report.BytesTransferred))
+	}
+	if report.MirrorPath != "" {
+		ObserveMirrorSize(r, report.Remote, report.MirrorPath)
+	}
+}
+
+// ObserveMirrorSize records the size of a mirror, or a network object store, on disk
+func ObserveMirrorSize(r *Registry, remote, mirror string) {
+	if size, err := config.DirSize(mirror); err == nil {
+		r.Set(MirrorBytes, Labels{"remote": remote, "mirror": mirror}, float64(size))
+	}
+}
@@ -0,0 +1,329 @@
+// Package metrics collects mirror cache metrics in the Prometheus text format
+// They are written to a node_exporter textfile collector file after each run,
+// or served over HTTP by a long running process
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// DefaultBuckets are the histogram upper bounds in seconds
+// git operations range from a local fetch to a multi minute clone
+var DefaultBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// Metric types
+const (
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+)
+
+// Labels are the label names and values of a series
+type Labels map[string]string
+
+// labelEscaper escapes label values like the Prometheus text format. Other
+// characters, including non-ASCII ones, are written as is
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// String renders the labels in sorted order. ex. a="1",b="2"
+func (l Labels) String() string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(l[name])))
+	}
+	return strings.Join(parts, ",")
+}
+
+type histogram struct {
+	// cumulative counts for each of DefaultBuckets
+	buckets []float64
+	sum     float64
+	count   float64
+}
+
+type family struct {
+	help   string
+	kind   string
+	values map[string]float64
+	hists  map[string]*histogram
+}
+
+// Registry holds metric families and their series
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// Default is the registry used by the commands
+var Default = NewRegistry()
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// Register declares a metric family. Series of undeclared families are ignored
+func (r *Registry) Register(name, kind, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[name]; !ok {
+		r.families[name] = &family{help: help, kind: kind, values: map[string]float64{}, hists: map[string]*histogram{}}
+	}
+}
+
+// Add increments a counter
+func (r *Registry) Add(name string, labels Labels, v float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok && f.kind == Counter {
+		f.values[labels.String()] += v
+	}
+}
+
+// Set sets a gauge
+func (r *Registry) Set(name string, labels Labels, v float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok && f.kind == Gauge {
+		f.values[labels.String()] = v
+	}
+}
+
+// Observe adds an observation to a histogram
+func (r *Registry) Observe(name string, labels Labels, v float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok || f.kind != Histogram {
+		return
+	}
+	h := f.histogram(labels.String())
+	for i, bound := range DefaultBuckets {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (f *family) histogram(labels string) *histogram {
+	h, ok := f.hists[labels]
+	if !ok {
+		h = &histogram{buckets: make([]float64, len(DefaultBuckets))}
+		f.hists[labels] = h
+	}
+	return h
+}
+
+// WriteText writes all the series in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		f := r.families[name]
+		if len(f.values) == 0 && len(f.hists) == 0 {
+			continue
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.kind)
+		for _, labels := range sortedKeys(f.values) {
+			fmt.Fprintf(bw, "%s%s %s\n", name, braces(labels), formatValue(f.values[labels]))
+		}
+		for _, labels := range sortedHistKeys(f.hists) {
+			h := f.hists[labels]
+			for i, bound := range DefaultBuckets {
+				fmt.Fprintf(bw, "%s_bucket%s %s\n", name, braces(join(labels, `le="`+formatValue(bound)+`"`)), formatValue(h.buckets[i]))
+			}
+			fmt.Fprintf(bw, "%s_bucket%s %s\n", name, braces(join(labels, `le="+Inf"`)), formatValue(h.count))
+			fmt.Fprintf(bw, "%s_sum%s %s\n", name, braces(labels), formatValue(h.sum))
+			fmt.Fprintf(bw, "%s_count%s %s\n", name, braces(labels), formatValue(h.count))
+		}
+	}
+	return bw.Flush()
+}
+
+// Merge adds the counters and histograms from a previous WriteText to the registry
+// Gauges from the previous text are kept unless the registry already set them
+// This lets each short lived run accumulate into the same textfile
+func (r *Registry) Merge(text io.Reader) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	scanner := bufio.NewScanner(text)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, labels, value, err := parseLine(line)
+		if err != nil {
+			return err
+		}
+		if f, ok := r.families[name]; ok {
+			switch f.kind {
+			case Counter:
+				f.values[labels] += value
+			case Gauge:
+				if _, set := f.values[labels]; !set {
+					f.values[labels] = value
+				}
+			}
+			continue
+		}
+		r.mergeHistogramLine(name, labels, value)
+	}
+	return scanner.Err()
+}
+
+// mergeHistogramLine adds a _bucket, _sum or _count line to its histogram
+func (r *Registry) mergeHistogramLine(name, labels string, value float64) {
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		f, ok := r.families[strings.TrimSuffix(name, suffix)]
+		if !strings.HasSuffix(name, suffix) || !ok || f.kind != Histogram {
+			continue
+		}
+		switch suffix {
+		case "_sum":
+			f.histogram(labels).sum += value
+		case "_count":
+			f.histogram(labels).count += value
+		case "_bucket":
+			rest, le := splitLe(labels)
+			for i, bound := range DefaultBuckets {
+				if formatValue(bound) == le {
+					f.histogram(rest).buckets[i] += value
+				}
+			}
+		}
+	}
+}
+
+// WriteTextfile merges the registry into a node_exporter textfile collector file
+// The file is locked while it is updated and replaced atomically
+func (r *Registry) WriteTextfile(path string) error {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	if previous, err := os.Open(path); err == nil {
+		err = r.Merge(previous)
+		previous.Close()
+		if err != nil {
+			return fmt.Errorf("unable to read metrics file %s: %w", path, err)
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".cache_clone_metrics")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = r.WriteText(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Handler serves the registry in the Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WriteText(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// parseLine splits a sample line into its name, labels and value
+func parseLine(line string) (name, labels string, value float64, err error) {
+	i := strings.LastIndex(line, " ")
+	if i < 0 {
+		return "", "", 0, fmt.Errorf("invalid metrics line: %s", line)
+	}
+	if value, err = strconv.ParseFloat(line[i+1:], 64); err != nil {
+		return "", "", 0, fmt.Errorf("invalid metrics line: %s", line)
+	}
+	series := line[:i]
+	if j := strings.Index(series, "{"); j >= 0 {
+		return series[:j], strings.TrimSuffix(series[j+1:], "}"), value, nil
+	}
+	return series, "", value, nil
+}
+
+// splitLe removes the le label from a rendered label string
+func splitLe(labels string) (rest, le string) {
+	i := strings.LastIndex(labels, `le="`)
+	if i < 0 {
+		return labels, ""
+	}
+	le = strings.TrimSuffix(labels[i+4:], `"`)
+	return strings.TrimSuffix(labels[:i], ","), le
+}
+
+func join(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedHistKeys(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/natemarks/cache_clone/types"
+)
+
+// TestWriteTextfile checks that runs accumulate in the same textfile
+func TestWriteTextfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache_clone.prom")
+	reports := []types.Report{
+		{Command: "clone", Remote: "https://host/a.git", MirrorAction: types.MirrorCreated, FetchDurationSeconds: 20, BytesTransferred: 100, DurationSeconds: 25, Success: true},
+		{Command: "clone", Remote: "https://host/a.git", MirrorAction: types.MirrorReused, FetchDurationSeconds: 0.3, DurationSeconds: 1, Success: true},
+		{Command: "clone", Remote: "https://host/a.git", DurationSeconds: 1, ErrorClass: types.ErrorClassAuth},
+	}
+	// each run is a separate process with a fresh registry
+	for _, report := range reports {
+		r := NewRegistry()
+		RegisterCacheMetrics(r)
+		ObserveReport(r, report)
+		if err := r.WriteTextfile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	for _, want := range []string{
+		`cache_clone_cache_hits_total{remote="https://host/a.git"} 1`,
+		`cache_clone_cache_misses_total{remote="https://host/a.git"} 1`,
+		`cache_clone_fetch_bytes_total{remote="https://host/a.git"} 100`,
+		`cache_clone_auth_failures_total{error_class="auth",remote="https://host/a.git"} 1`,
+		`cache_clone_run_duration_seconds_bucket{command="clone",le="1"} 2`,
+		`cache_clone_run_duration_seconds_bucket{command="clone",le="+Inf"} 3`,
+		`cache_clone_run_duration_seconds_sum{command="clone"} 27`,
+		`cache_clone_runs_total{command="clone",error_class="",result="success"} 2`,
+		`# TYPE cache_clone_fetch_duration_seconds histogram`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("metrics file is missing %s:\n%s", want, text)
+		}
+	}
+}
+
+// TestLabelsString checks label values are escaped like the Prometheus text format
+func TestLabelsString(t *testing.T) {
+	l := Labels{"remote": "https://host/é\tb", "msg": "a \"b\"\\c\nd"}
+	want := `msg="a \"b\"\\c\nd",remote="https://host/é` + "\t" + `b"`
+	if got := l.String(); got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+
+	// a series with escapes is merged with the one already in the file
+	path := filepath.Join(t.TempDir(), "cache_clone.prom")
+	for i := 0; i < 2; i++ {
+		r := NewRegistry()
+		r.Register("test_total", Counter, "test")
+		r.Add("test_total", l, 1)
+		if err := r.WriteTextfile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "test_total{"+want+"} 2\n") {
+		t.Errorf("metrics file:\n%s", data)
+	}
+}
@@ -0,0 +1,367 @@
+// Package scheduler refreshes mirrors in the background so clones rarely fetch
+// from the remote on their critical path
+//
+// Each mirror is refreshed at an interval based on how often it is used: a mirror
+// cloned every minute is fetched every minute, a cold mirror every MaxInterval.
+// Intervals are jittered so mirrors don't refresh in lockstep, failed refreshes
+// back off, and no more than Concurrency fetches run at once
+package scheduler
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/metrics"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+)
+
+// Defaults for the daemon flags
+const (
+	DefaultConcurrency = 4
+	DefaultMinInterval = time.Minute
+	DefaultMaxInterval = time.Hour
+	DefaultJitter      = 0.1
+	// bundles are uploaded to the bundle store at most this often per mirror
+	DefaultBundleInterval = 6 * time.Hour
+	DefaultBundleKeep     = 2
+)
+
+// scanInterval is how often the mirror root is checked for due mirrors
+const scanInterval = 15 * time.Second
+
+// RefreshesTotal counts background refreshes by result
+const RefreshesTotal = "cache_clone_refreshes_total"
+
+func init() {
+	metrics.Default.Register(RefreshesTotal, metrics.Counter, "background mirror refreshes by result")
+}
+
+// Scheduler refreshes the mirrors under the mirror root
+type Scheduler struct {
+	s    config.Settings
+	cred *types.Credential
+	log  *zerolog.Logger
+	// nil without a bundle store
+	bundles *types.BundleStore
+	// limits the fetches that run at once
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	mirrors map[string]*entry
+	// serializes credential refreshes. they call AWS or the GitHub API, so never under mu
+	credMu sync.Mutex
+}
+
+// entry is the schedule of one mirror
+type entry struct {
+	running bool
+	// a webhook arrived while the mirror was refreshing. refresh it again
+	pending  bool
+	interval time.Duration
+	failures int
+	// no refresh before this time after a failure
+	retryAt time.Time
+}
+
+// New returns a scheduler for the mirror root in s
+// cred is shared by every refresh and refreshed when it is about to expire
+func New(s config.Settings, cred *types.Credential, log *zerolog.Logger) *Scheduler {
+	concurrency := s.RefreshConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	return &Scheduler{
+		s:       s,
+		cred:    cred,
+		log:     log,
+		bundles: types.NewBundleStore(s, log),
+		slots:   make(chan struct{}, concurrency),
+		mirrors: map[string]*entry{},
+	}
+}
+
+// Run refreshes due mirrors until ctx is cancelled, then waits for running refreshes
+func (sc *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(scanInterval)
+	defer ticker.Stop()
+	for {
+		sc.Scan(ctx)
+		select {
+		case <-ctx.Done():
+			sc.wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scan starts a refresh of every due mirror that isn't already refreshing
+func (sc *Scheduler) Scan(ctx context.Context) {
+	paths, err := FindMirrors(sc.s.Mirror)
+	if err != nil {
+		sc.log.Error().Err(err).Msgf("unable to scan mirror root %s", sc.s.Mirror)
+		return
+	}
+	now := time.Now()
+	for _, p := range paths {
+		m := sc.mirror(p)
+		sc.mu.Lock()
+		e, ok := sc.mirrors[p]
+		if !ok {
+			e = &entry{}
+			sc.mirrors[p] = e
+		}
+		due := !e.running && sc.due(m, e, now)
+		if due {
+			e.running = true
+		}
+		sc.mu.Unlock()
+		if !due {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			sc.mu.Lock()
+			e.running = false
+			sc.mu.Unlock()
+			return
+		case sc.slots <- struct{}{}:
+		}
+		sc.start(m, e)
+	}
+}
+
+// RefreshNow refreshes the mirror at path as soon as a slot is free
+// The failure backoff is ignored. A mirror that is refreshing now is refreshed
+// again when it finishes, so a change pushed during the fetch isn't missed
+func (sc *Scheduler) RefreshNow(path string) {
+	m := sc.mirror(path)
+	sc.mu.Lock()
+	e, ok := sc.mirrors[path]
+	if !ok {
+		e = &entry{}
+		sc.mirrors[path] = e
+	}
+	if e.running {
+		e.pending = true
+		sc.mu.Unlock()
+		return
+	}
+	e.running = true
+	sc.mu.Unlock()
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		sc.slots <- struct{}{}
+		defer func() { <-sc.slots }()
+		sc.refresh(m, e)
+	}()
+}
+
+// start refreshes a mirror that holds a slot in a new goroutine
+func (sc *Scheduler) start(m *types.Mirror, e *entry) {
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		defer func() { <-sc.slots }()
+		sc.refresh(m, e)
+	}()
+}
+
+// due returns true if the mirror should be refreshed now
+// The interval is picked when the mirror is first seen and after each refresh
+func (sc *Scheduler) due(m *types.Mirror, e *entry, now time.Time) bool {
+	if now.Before(e.retryAt) {
+		return false
+	}
+	if e.interval == 0 {
+		rate, err := m.AccessRate()
+		if err != nil {
+			sc.log.Warn().Err(err).Msgf("unable to read access rate of %s", m.Path)
+		}
+		e.interval = Jitter(Interval(rate, sc.minInterval(), sc.maxInterval()), sc.s.RefreshJitter)
+	}
+	fetched, err := m.LastFetched()
+	return err != nil || now.Sub(fetched) >= e.interval
+}
+
+// refresh fetches one mirror and updates its schedule
+// Each refresh is its own operation, so it doesn't share a tracing parent with the others
+func (sc *Scheduler) refresh(m *types.Mirror, e *entry) {
+	err := sc.fetch(context.Background(), m)
+	rate, rateErr := m.AccessRate()
+	if rateErr != nil {
+		sc.log.Warn().Err(rateErr).Msgf("unable to read access rate of %s", m.Path)
+	}
+	if sc.reschedule(m, e, rate, err) {
+		sc.RefreshNow(m.Path)
+	}
+}
+
+// reschedule picks the next refresh after a fetch and returns true if a webhook
+// asked for another refresh while it ran
+func (sc *Scheduler) reschedule(m *types.Mirror, e *entry, rate float64, err error) (pending bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e.running = false
+	pending, e.pending = e.pending, false
+	e.interval = Jitter(Interval(rate, sc.minInterval(), sc.maxInterval()), sc.s.RefreshJitter)
+	if err != nil {
+		e.failures++
+		backoff := Backoff(e.failures, sc.minInterval(), sc.maxInterval())
+		e.retryAt = time.Now().Add(backoff)
+		sc.log.Error().Err(err).Str("errorClass", types.ErrorClass(err)).Msgf("unable to refresh %s. retrying in %s", m.Path, backoff)
+		metrics.Default.Add(RefreshesTotal, metrics.Labels{"result": "failure", "error_class": types.ErrorClass(err)}, 1)
+		return pending
+	}
+	e.failures = 0
+	e.retryAt = time.Time{}
+	sc.log.Info().Msgf("refreshed %s (%s). next in %s", m.Path, m.Action, e.interval.Round(time.Second))
+	metrics.Default.Add(RefreshesTotal, metrics.Labels{"result": "success", "error_class": ""}, 1)
+	return pending
+}
+
+// fetch updates a mirror from its remote with the credential
+func (sc *Scheduler) fetch(ctx context.Context, m *types.Mirror) error {
+	remote, err := m.Remote(ctx)
+	if err != nil {
+		return err
+	}
+	if !types.AllowedHost(sc.s, remote.Host) {
+		return &types.Error{Class: types.ErrorClassCredential, Msg: "host " + remote.Host + " is not allowed. add it with --allow-host"}
+	}
+	sc.credMu.Lock()
+	err = sc.cred.Refresh(sc.log)
+	cred := *sc.cred
+	sc.credMu.Unlock()
+	if err != nil {
+		return &types.Error{Class: types.ErrorClassCredential, Msg: "unable to refresh credential", Err: err}
+	}
+	if err = m.UpdateClone(ctx, *remote, cred, sc.log); err != nil {
+		return err
+	}
+	labels := metrics.Labels{"remote": remote.URL.String()}
+	metrics.Default.Observe(metrics.FetchDuration, metrics.Labels{"remote": labels["remote"], "action": m.Action}, m.FetchDuration.Seconds())
+	metrics.Default.Add(metrics.FetchBytesTotal, labels, float64(m.BytesTransferred))
+	sc.uploadBundle(ctx, m, *remote)
+	return nil
+}
+
+// uploadBundle uploads a bundle of the mirror when the last one is older than BundleInterval
+// A failed upload is only logged. The mirror itself was refreshed
+func (sc *Scheduler) uploadBundle(ctx context.Context, m *types.Mirror, remote types.HTTPSRemote) {
+	if m.Bundles == nil || sc.s.BundleInterval <= 0 {
+		return
+	}
+	if last, err := m.LastBundled(); err == nil && time.Since(last) < sc.s.BundleInterval {
+		return
+	}
+	if err := m.UploadBundle(ctx, remote, sc.s.BundleKeep, sc.log); err != nil {
+		sc.log.Warn().Err(err).Msgf("unable to upload bundle of %s", m.Path)
+	}
+}
+
+// mirror returns the mirror at path
+func (sc *Scheduler) mirror(path string) *types.Mirror {
+	return &types.Mirror{Path: path, Perms: sc.perms(), Bundles: sc.bundles}
+}
+
+// perms returns the mirror permissions from the settings, or the defaults
+func (sc *Scheduler) perms() config.Permissions {
+	perms, err := config.ParsePermissions(sc.s)
+	if err != nil {
+		perms, _ = config.ParsePermissions(config.Settings{})
+	}
+	return perms
+}
+
+// minInterval returns the shortest refresh interval and the first failure backoff
+func (sc *Scheduler) minInterval() time.Duration {
+	if sc.s.MinRefreshInterval <= 0 {
+		return DefaultMinInterval
+	}
+	return sc.s.MinRefreshInterval
+}
+
+// maxInterval returns the refresh interval of unused mirrors and the longest backoff
+func (sc *Scheduler) maxInterval() time.Duration {
+	if sc.s.MaxRefreshInterval <= 0 {
+		return DefaultMaxInterval
+	}
+	return sc.s.MaxRefreshInterval
+}
+
+// Interval returns the refresh interval for a mirror used rate times an hour
+// It aims for about one refresh between uses, between min and max
+func Interval(rate float64, min, max time.Duration) time.Duration {
+	if rate <= 0 {
+		return max
+	}
+	interval := time.Duration(float64(time.Hour) / rate)
+	if interval < min {
+		return min
+	}
+	if interval > max {
+		return max
+	}
+	return interval
+}
+
+// Jitter returns d moved randomly by up to fraction of d in either direction
+func Jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
+
+// Backoff returns the wait after a number of consecutive failures
+// It doubles from min and is capped at max
+func Backoff(failures int, min, max time.Duration) time.Duration {
+	backoff := float64(min) * math.Pow(2, float64(failures-1))
+	if backoff > float64(max) {
+		return max
+	}
+	return time.Duration(backoff)
+}
+
+// FindMirrors returns the bare repos under the mirror root
+func FindMirrors(root string) ([]string, error) {
+	var mirrors []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		// network object stores aren't mirrors
+		if info.Name() == types.NetworksDir {
+			return filepath.SkipDir
+		}
+		if isBareRepo(p) {
+			mirrors = append(mirrors, p)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return mirrors, err
+}
+
+// isBareRepo returns true if dir looks like a bare git repo
+func isBareRepo(dir string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+package scheduler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+)
+
+func TestInterval(t *testing.T) {
+	tests := []struct {
+		rate float64
+		want time.Duration
+	}{
+		{0, time.Hour},
+		{0.5, time.Hour},
+		{4, 15 * time.Minute},
+		{600, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := Interval(tt.rate, time.Minute, time.Hour); got != tt.want {
+			t.Errorf("Interval(%v) = %s, want %s", tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if got := Jitter(time.Minute, 0.1); got < 54*time.Second || got > 66*time.Second {
+			t.Fatalf("Jitter(1m, 0.1) = %s", got)
+		}
+	}
+	if got := Jitter(time.Minute, 0); got != time.Minute {
+		t.Errorf("Jitter(1m, 0) = %s", got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute}
+	for i, w := range want {
+		if got := Backoff(i+1, time.Minute, 10*time.Minute); got != w {
+			t.Errorf("Backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
+
+func TestFindMirrors(t *testing.T) {
+	root := t.TempDir()
+	for _, repo := range []string{"my.git.host/a/one.git", "my.git.host/b/two", "other.host/three.git"} {
+		for _, dir := range []string{"objects", "refs"} {
+			if err := os.MkdirAll(filepath.Join(root, repo, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(root, repo, "HEAD"), []byte("ref: refs/heads/main\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not a repo
+	if err := os.MkdirAll(filepath.Join(root, "my.git.host", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	got, err := FindMirrors(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(root, "my.git.host/a/one.git"),
+		filepath.Join(root, "my.git.host/b/two"),
+		filepath.Join(root, "other.host/three.git"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindMirrors() = %v, want %v", got, want)
+	}
+}
+
+// run runs git and fails the test if it fails
+func run(t *testing.T, args ...string) string {
+	t.Helper()
+	result, err := config.Run(context.Background(), append([]string{"git", "-c", "user.name=a", "-c", "user.email=a@b"}, args...))
+	if err != nil || result.ReturnCode != 0 {
+		t.Fatalf("git %v: %s", args, result.String())
+	}
+	return result.StdOut
+}
+
+func TestScanBackoff(t *testing.T) {
+	log := zerolog.Nop()
+	repos, work, root := t.TempDir(), t.TempDir(), t.TempDir()
+	upstream := filepath.Join(repos, "org", "repo.git")
+	run(t, "init", "-q", "-b", "main", work)
+	run(t, "-C", work, "commit", "-q", "--allow-empty", "-m", "one")
+	run(t, "clone", "-q", "--bare", work, upstream)
+
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("no git")
+	}
+	backend := &cgi.Handler{
+		Path:   gitPath,
+		Args:   []string{"http-backend"},
+		Env:    []string{"GIT_PROJECT_ROOT=" + repos, "GIT_HTTP_EXPORT_ALL=1"},
+		Stderr: io.Discard,
+	}
+	var down atomic.Bool
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	remote := srv.URL + "/org/repo.git"
+	mirror := filepath.Join(root, "mirror.git")
+	// cloned by an older version, so it has no fetch time and is due
+	run(t, "clone", "-q", "--mirror", remote, mirror)
+	run(t, "-C", work, "commit", "-q", "--allow-empty", "-m", "two")
+	run(t, "-C", work, "push", "-q", upstream, "main")
+
+	s := config.Settings{Mirror: root, Remote: remote, MinRefreshInterval: time.Hour, MaxRefreshInterval: 4 * time.Hour}
+	sc := New(s, &types.Credential{}, &log)
+	entry := func() entry {
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		return *sc.mirrors[mirror]
+	}
+	ctx := context.Background()
+	sc.Scan(ctx)
+	sc.wg.Wait()
+	if e := entry(); e.failures != 0 || e.running || e.interval < 3*time.Hour {
+		t.Errorf("after a refresh: %+v", e)
+	}
+	if got, want := run(t, "-C", mirror, "rev-parse", "main"), run(t, "-C", upstream, "rev-parse", "main"); got != want {
+		t.Errorf("mirror main = %s, want %s", got, want)
+	}
+
+	// a failed refresh backs off from the min interval
+	down.Store(true)
+	sc.RefreshNow(mirror)
+	sc.wg.Wait()
+	e := entry()
+	if e.failures != 1 || time.Until(e.retryAt) < 59*time.Minute || time.Until(e.retryAt) > time.Hour {
+		t.Errorf("after a failure: %+v", e)
+	}
+	// even a mirror that is due isn't fetched before retryAt
+	forget := func() {
+		os.Remove(filepath.Join(mirror, "cache_clone.fetched"))
+		os.Remove(filepath.Join(mirror, "FETCH_HEAD"))
+	}
+	forget()
+	before := requests.Load()
+	sc.Scan(ctx)
+	sc.wg.Wait()
+	if requests.Load() != before {
+		t.Error("Scan() fetched a mirror that is backing off")
+	}
+	sc.RefreshNow(mirror)
+	sc.wg.Wait()
+	if e := entry(); e.failures != 2 || time.Until(e.retryAt) < 119*time.Minute {
+		t.Errorf("after a second failure: %+v", e)
+	}
+
+	down.Store(false)
+	sc.mu.Lock()
+	sc.mirrors[mirror].retryAt = time.Time{}
+	sc.mu.Unlock()
+	forget()
+	sc.Scan(ctx)
+	sc.wg.Wait()
+	if e := entry(); e.failures != 0 || !e.retryAt.IsZero() {
+		t.Errorf("after recovering: %+v", e)
+	}
+}
@@ -0,0 +1,223 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/natemarks/cache_clone/metrics"
+	"github.com/natemarks/cache_clone/types"
+)
+
+// Webhook providers
+const (
+	GitHub          = "github"
+	GitLab          = "gitlab"
+	BitbucketServer = "bitbucket-server"
+)
+
+// maxWebhookBody is the largest payload accepted. GitHub caps payloads at 25MB
+const maxWebhookBody = 25 << 20
+
+// WebhooksTotal counts received webhooks by provider and result
+const WebhooksTotal = "cache_clone_webhooks_total"
+
+func init() {
+	metrics.Default.Register(WebhooksTotal, metrics.Counter, "received push webhooks by provider and result")
+}
+
+// errSignature is returned for a webhook without a valid signature or token
+var errSignature = errors.New("invalid webhook signature")
+
+// Webhook is a push notification
+type Webhook struct {
+	Provider string
+	Event    string
+	// clone URLs of the pushed repository
+	URLs []string
+}
+
+// WebhookHandler returns the endpoint for push webhooks signed with secret
+// GitHub and Bitbucket Server sign the payload with HMAC-SHA256. GitLab sends the
+// secret token in a header. Each pushed repository with a mirror is refreshed now
+func (sc *Scheduler) WebhookHandler(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "webhooks are POST requests", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+		if err != nil {
+			http.Error(w, "unable to read webhook", http.StatusBadRequest)
+			return
+		}
+		hook, err := ParseWebhook(r.Header, body, secret)
+		labels := metrics.Labels{"provider": hook.Provider}
+		switch {
+		case errors.Is(err, errSignature):
+			sc.log.Warn().Str("provider", hook.Provider).Msg("rejected webhook with an invalid signature")
+			labels["result"] = "unauthorized"
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case err != nil:
+			sc.log.Warn().Err(err).Str("provider", hook.Provider).Msg("unable to parse webhook")
+			labels["result"] = "invalid"
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case len(hook.URLs) == 0:
+			// ping and other events
+			labels["result"] = "ignored"
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			mirrors := sc.mirrorsFor(r.Context(), hook.URLs)
+			labels["result"] = "refreshed"
+			if len(mirrors) == 0 {
+				labels["result"] = "no_mirror"
+			}
+			for _, p := range mirrors {
+				sc.log.Info().Str("provider", hook.Provider).Msgf("webhook: refreshing %s", p)
+				sc.RefreshNow(p)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string][]string{"mirrors": mirrors})
+		}
+		metrics.Default.Add(WebhooksTotal, labels, 1)
+	})
+}
+
+// mirrorsFor returns the existing mirrors for the clone URLs of one repository
+func (sc *Scheduler) mirrorsFor(ctx context.Context, urls []string) []string {
+	var mirrors []string
+	for _, u := range urls {
+		remote, err := types.NewRemote(u)
+		if err != nil || types.ReservedHost(remote.Normalize(sc.s).Host) {
+			continue
+		}
+		s := sc.s
+		s.Remote = u
+		m := types.NewMirror(s, sc.log)
+		if !m.CheckClone(ctx, sc.log) || containsString(mirrors, m.Path) {
+			continue
+		}
+		mirrors = append(mirrors, m.Path)
+	}
+	return mirrors
+}
+
+// ParseWebhook verifies a webhook and returns the clone URLs of the pushed repository
+// Events other than pushes return no URLs
+func ParseWebhook(header http.Header, body []byte, secret string) (Webhook, error) {
+	var hook Webhook
+	switch {
+	case header.Get("X-GitHub-Event") != "":
+		hook = Webhook{Provider: GitHub, Event: header.Get("X-GitHub-Event")}
+		if !validHMAC(header.Get("X-Hub-Signature-256"), body, secret) {
+			return hook, errSignature
+		}
+		if hook.Event != "push" {
+			return hook, nil
+		}
+		var payload struct {
+			Repository struct {
+				CloneURL string `json:"clone_url"`
+				HTMLURL  string `json:"html_url"`
+			} `json:"repository"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return hook, err
+		}
+		hook.URLs = nonEmpty(payload.Repository.CloneURL, payload.Repository.HTMLURL)
+	case header.Get("X-Gitlab-Event") != "":
+		hook = Webhook{Provider: GitLab, Event: header.Get("X-Gitlab-Event")}
+		if secret == "" || subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(secret)) != 1 {
+			return hook, errSignature
+		}
+		if hook.Event != "Push Hook" && hook.Event != "Tag Push Hook" {
+			return hook, nil
+		}
+		var payload struct {
+			Project struct {
+				GitHTTPURL string `json:"git_http_url"`
+				WebURL     string `json:"web_url"`
+			} `json:"project"`
+			Repository struct {
+				GitHTTPURL string `json:"git_http_url"`
+			} `json:"repository"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return hook, err
+		}
+		hook.URLs = nonEmpty(payload.Project.GitHTTPURL, payload.Repository.GitHTTPURL, payload.Project.WebURL)
+	case header.Get("X-Event-Key") != "":
+		hook = Webhook{Provider: BitbucketServer, Event: header.Get("X-Event-Key")}
+		if !validHMAC(header.Get("X-Hub-Signature"), body, secret) {
+			return hook, errSignature
+		}
+		if hook.Event != "repo:refs_changed" {
+			return hook, nil
+		}
+		var payload struct {
+			Repository struct {
+				Links struct {
+					Clone []struct {
+						Href string `json:"href"`
+						Name string `json:"name"`
+					} `json:"clone"`
+				} `json:"links"`
+			} `json:"repository"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return hook, err
+		}
+		for _, link := range payload.Repository.Links.Clone {
+			if strings.HasPrefix(link.Name, "http") {
+				hook.URLs = append(hook.URLs, link.Href)
+			}
+		}
+	default:
+		return Webhook{Provider: "unknown"}, fmt.Errorf("unknown webhook. expected a GitHub, GitLab or Bitbucket Server push event")
+	}
+	return hook, nil
+}
+
+// validHMAC returns true if signature is sha256=<hex HMAC-SHA256 of body with secret>
+func validHMAC(signature string, body []byte, secret string) bool {
+	if secret == "" || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// nonEmpty returns the values that aren't empty
+func nonEmpty(values ...string) []string {
+	var out []string
+	for _, v := range values {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// containsString returns true if list contains s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+)
+
+func sign(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestParseWebhook(t *testing.T) {
+	github := `{"repository":{"clone_url":"https://github.com/org/repo.git","html_url":"https://github.com/org/repo"}}`
+	gitlab := `{"project":{"git_http_url":"https://gitlab.com/org/repo.git","web_url":"https://gitlab.com/org/repo"}}`
+	bitbucket := `{"repository":{"links":{"clone":[{"href":"ssh://git@stash.example.com:7999/org/repo.git","name":"ssh"},{"href":"https://stash.example.com/scm/org/repo.git","name":"http"}]}}}`
+	tests := []struct {
+		name    string
+		header  map[string]string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{"github push", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": sign(github, "s3cret")}, github,
+			[]string{"https://github.com/org/repo.git", "https://github.com/org/repo"}, false},
+		{"github ping", map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": sign("{}", "s3cret")}, "{}", nil, false},
+		{"github bad signature", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": sign(github, "wrong")}, github, nil, true},
+		{"github unsigned", map[string]string{"X-GitHub-Event": "push"}, github, nil, true},
+		{"gitlab push", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "s3cret"}, gitlab,
+			[]string{"https://gitlab.com/org/repo.git", "https://gitlab.com/org/repo"}, false},
+		{"gitlab bad token", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "wrong"}, gitlab, nil, true},
+		{"bitbucket push", map[string]string{"X-Event-Key": "repo:refs_changed", "X-Hub-Signature": sign(bitbucket, "s3cret")}, bitbucket,
+			[]string{"https://stash.example.com/scm/org/repo.git"}, false},
+		{"bitbucket ping", map[string]string{"X-Event-Key": "diagnostics:ping", "X-Hub-Signature": sign("{}", "s3cret")}, "{}", nil, false},
+		{"unknown", map[string]string{}, "{}", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range tt.header {
+				header.Set(k, v)
+			}
+			hook, err := ParseWebhook(header, []byte(tt.body), "s3cret")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseWebhook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(hook.URLs, tt.want) {
+				t.Errorf("ParseWebhook() URLs = %v, want %v", hook.URLs, tt.want)
+			}
+		})
+	}
+}
+
+func TestMirrorsFor(t *testing.T) {
+	log := zerolog.Nop()
+	root := t.TempDir()
+	upstream := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", upstream},
+		{"clone", "-q", "--mirror", upstream, filepath.Join(root, "github.com", "org", "repo.git")},
+		{"clone", "-q", "--bare", upstream, types.NetworkStore(root, "abc")},
+	} {
+		if result, err := config.Run(context.Background(), append([]string{"git"}, args...)); err != nil || result.ReturnCode != 0 {
+			t.Fatalf("git %v: %s", args, result.String())
+		}
+	}
+	sc := New(config.Settings{Mirror: root}, nil, &log)
+	got := sc.mirrorsFor(context.Background(), []string{
+		"https://github.com/org/repo",
+		"https://github.com/org/repo.git",
+		"https://cache_clone.networks/abc.git",
+		"https://CACHE_CLONE.NETWORKS:443/abc",
+		"https://cache_clone.index/x.git",
+	})
+	if want := []string{filepath.Join(root, "github.com", "org", "repo.git")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mirrorsFor() = %v, want %v", got, want)
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	log := zerolog.Nop()
+	sc := New(config.Settings{Mirror: t.TempDir()}, nil, &log)
+	handler := sc.WebhookHandler("s3cret")
+	body := `{"repository":{"clone_url":"https://github.com/org/repo.git"}}`
+	tests := []struct {
+		name      string
+		method    string
+		signature string
+		want      int
+	}{
+		{"get", http.MethodGet, sign(body, "s3cret"), http.StatusMethodNotAllowed},
+		{"bad signature", http.MethodPost, sign(body, "wrong"), http.StatusUnauthorized},
+		// no mirror for the repo, so nothing is refreshed
+		{"push", http.MethodPost, sign(body, "s3cret"), http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/webhook", strings.NewReader(body))
+			req.Header.Set("X-GitHub-Event", "push")
+			req.Header.Set("X-Hub-Signature-256", tt.signature)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/types"
+)
+
+// forwardPush sends a receive-pack request to the remote with the credential
+// git clients configured with url.<base>.insteadOf push through the proxy too,
+// so they can push without a credential of their own
+func (sv *Server) forwardPush(w http.ResponseWriter, r *http.Request, repo string) {
+	host := strings.SplitN(repo, "/", 2)[0]
+	if sv.cred == nil || !types.AllowedHost(sv.s, host) {
+		http.Error(w, "pushes to "+host+" are not forwarded", http.StatusForbidden)
+		return
+	}
+	cred, err := sv.credential()
+	if err != nil {
+		sv.log.Error().Err(err).Msg("unable to forward push")
+		http.Error(w, "unable to forward push", http.StatusBadGateway)
+		return
+	}
+	target := &url.URL{Scheme: sv.upstreamScheme(), Host: host}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			// /<host>/<path>/git-receive-pack -> <scheme>://<host>/<path>/git-receive-pack
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = strings.TrimPrefix(req.URL.Path, "/"+host)
+			req.URL.RawPath = ""
+			req.Host = target.Host
+			setAuthorization(req, cred)
+		},
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			sv.log.Error().Err(config.RedactError(err)).Msgf("unable to forward push to %s", host)
+			http.Error(w, "unable to forward push", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	// the remote may have new refs. fetch them before the next clone
+	if r.Method == http.MethodPost {
+		sv.log.Info().Msgf("forwarded push to %s://%s", target.Scheme, repo)
+		sv.markStale(repo)
+	}
+}
+
+// setAuthorization replaces the Authorization header with the credential
+func setAuthorization(req *http.Request, c types.Credential) {
+	req.Header.Del("Authorization")
+	if c.Type == types.BearerCredential {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+		return
+	}
+	req.SetBasicAuth(c.Username, c.Token)
+}
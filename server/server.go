@@ -0,0 +1,320 @@
+// Package server serves the mirror root as a read-only git smart-HTTP endpoint
+// so containers on the host can clone through a URL instead of a volume mount
+// Requests are handed to git http-backend. Pushes are refused, or forwarded
+// to the remote when the server is used as a caching proxy
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/metrics"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+)
+
+// DefaultListen is the default serve address. it is only reachable from the host
+const DefaultListen = "127.0.0.1:8080"
+
+// DefaultUpstreamScheme is used to reach remotes when no scheme is set
+const DefaultUpstreamScheme = "https"
+
+// RequestsTotal counts served git requests by service and status code
+const RequestsTotal = "cache_clone_serve_requests_total"
+
+func init() {
+	metrics.Default.Register(RequestsTotal, metrics.Counter, "git requests served from the mirror root by service and status code")
+}
+
+// repoPattern splits a git request path into the repo and the git endpoint
+// ex. /my.git.host/my/repo.git/info/refs -> my.git.host/my/repo.git, info/refs
+var repoPattern = regexp.MustCompile(`^/(.+?)/(info/refs|git-upload-pack|git-receive-pack|HEAD|objects/.+)$`)
+
+// Server serves mirrors under s.Mirror
+// A request for a missing mirror of an allowed host creates it. An existing
+// mirror is refreshed when it is older than s.RefreshInterval
+type Server struct {
+	s       config.Settings
+	cred    *types.Credential
+	log     *zerolog.Logger
+	backend http.Handler
+
+	mu      sync.Mutex
+	mirrors map[string]*mirrorState
+}
+
+// mirrorState serializes the creation and refresh of one mirror
+type mirrorState struct {
+	sync.Mutex
+	fetched time.Time
+}
+
+// New returns a server for the mirror root in s
+// cred is used to create and refresh mirrors. When it's nil only existing
+// mirrors are served and they are never refreshed
+func New(s config.Settings, cred *types.Credential, log *zerolog.Logger) *Server {
+	// the CGI handler doesn't search PATH
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		log.Error().Err(err).Msg("git not found")
+	}
+	return &Server{
+		s:    s,
+		cred: cred,
+		log:  log,
+		backend: &cgi.Handler{
+			Path: gitPath,
+			Args: []string{"http-backend"},
+			Env: []string{
+				"GIT_PROJECT_ROOT=" + s.Mirror,
+				"GIT_HTTP_EXPORT_ALL=1",
+				// shared mirror roots are owned by other users
+				"GIT_CONFIG_COUNT=1",
+				"GIT_CONFIG_KEY_0=safe.directory",
+				"GIT_CONFIG_VALUE_0=*",
+			},
+			InheritEnv: []string{"PATH", "HOME"},
+		},
+		mirrors: map[string]*mirrorState{},
+	}
+}
+
+// Handler returns the git endpoint with /metrics and /healthz
+func (sv *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.Handle("/", sv)
+	return mux
+}
+
+// ServeHTTP serves one git request
+func (sv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+	service := sv.serve(rec, r)
+	metrics.Default.Add(RequestsTotal, metrics.Labels{"service": service, "code": strconv.Itoa(rec.code)}, 1)
+	sv.log.Debug().Str("service", service).Int("code", rec.code).Msgf("%s %s", r.Method, r.URL.Path)
+}
+
+// serve handles the request and returns the git service name for metrics
+func (sv *Server) serve(w http.ResponseWriter, r *http.Request) string {
+	repo, endpoint, ok := parseRequest(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return "unknown"
+	}
+	service := endpoint
+	if endpoint == "info/refs" {
+		service = r.URL.Query().Get("service")
+	}
+	if service == "git-receive-pack" || endpoint == "git-receive-pack" {
+		if !sv.s.ForwardPush {
+			http.Error(w, "this mirror is read-only. push to the remote", http.StatusForbidden)
+			return "git-receive-pack"
+		}
+		sv.forwardPush(w, r, repo)
+		return "git-receive-pack"
+	}
+	mirror, err := sv.mirror(repo)
+	if err != nil {
+		http.NotFound(w, r)
+		return service
+	}
+	// a fetch starts with the ref advertisement. that's when the mirror is checked
+	if endpoint == "info/refs" {
+		if err := sv.ensureMirror(r.Context(), repo, mirror); err != nil {
+			sv.log.Error().Err(err).Msgf("unable to serve %s", repo)
+			if errors.Is(err, os.ErrNotExist) {
+				http.NotFound(w, r)
+			} else {
+				http.Error(w, "unable to update mirror", http.StatusBadGateway)
+			}
+			return service
+		}
+	} else if !isDir(mirror.Path) {
+		http.NotFound(w, r)
+		return service
+	}
+	// equivalent URLs share the mirror of the normalized remote
+	rel, err := filepath.Rel(sv.s.Mirror, mirror.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return service
+	}
+	backend := r.Clone(r.Context())
+	backend.URL.Path = "/" + filepath.ToSlash(rel) + "/" + endpoint
+	backend.URL.RawPath = ""
+	sv.backend.ServeHTTP(w, backend)
+	return service
+}
+
+// mirror returns the mirror for repo (host/path)
+func (sv *Server) mirror(repo string) (*types.Mirror, error) {
+	settings := sv.s
+	settings.Remote = sv.upstreamScheme() + "://" + repo
+	remote, err := types.NewRemote(settings.Remote)
+	if err != nil {
+		return nil, err
+	}
+	// network object stores have every fork's refs and no origin
+	if types.ReservedHost(remote.Normalize(settings).Host) {
+		return nil, os.ErrNotExist
+	}
+	return types.NewMirror(settings, sv.log), nil
+}
+
+// parseRequest returns the repo (host/path) and git endpoint of a request path
+// Paths that try to leave the mirror root are refused
+func parseRequest(p string) (repo, endpoint string, ok bool) {
+	m := repoPattern.FindStringSubmatch(p)
+	if m == nil {
+		return "", "", false
+	}
+	repo = m[1]
+	if path.Clean("/"+repo) != "/"+repo || !strings.Contains(repo, "/") {
+		return "", "", false
+	}
+	return repo, m[2], true
+}
+
+// ensureMirror creates or refreshes the mirror for repo
+// A failed refresh is logged and the existing mirror is served
+// ctx only carries the tracing span. A client that goes away doesn't stop a clone others wait for
+func (sv *Server) ensureMirror(ctx context.Context, repo string, mirror *types.Mirror) error {
+	// equivalent request paths share one lock
+	sv.mu.Lock()
+	state, ok := sv.mirrors[mirror.Path]
+	if !ok {
+		state = &mirrorState{}
+		sv.mirrors[mirror.Path] = state
+	}
+	sv.mu.Unlock()
+	state.Lock()
+	defer state.Unlock()
+
+	host := strings.SplitN(repo, "/", 2)[0]
+	remote, err := types.NewRemote(sv.upstreamScheme() + "://" + repo)
+	if err != nil {
+		return os.ErrNotExist
+	}
+	cloned := mirror.CheckClone(ctx, sv.log)
+	defer func() {
+		if mirror.IsCloned {
+			if err := mirror.RecordAccess(); err != nil {
+				sv.log.Warn().Err(err).Msgf("unable to record access to %s", mirror.Path)
+			}
+		}
+	}()
+	if sv.cred == nil || !types.AllowedHost(sv.s, host) {
+		if !cloned {
+			return os.ErrNotExist
+		}
+		return nil
+	}
+	if cloned && !sv.s.CheckUpstream && (sv.s.RefreshInterval <= 0 || time.Since(state.fetched) < sv.s.RefreshInterval) {
+		return nil
+	}
+	cred, err := sv.credential()
+	if err != nil {
+		return err
+	}
+	if cloned && sv.s.CheckUpstream {
+		fresh, err := mirror.IsFresh(ctx, *remote, cred, sv.log)
+		if err != nil {
+			sv.log.Warn().Err(err).Msgf("unable to check mirror %s. serving it as is", mirror.Path)
+			return nil
+		}
+		if fresh {
+			return nil
+		}
+	}
+
+	// metrics of equivalent request paths share the normalized remote
+	labels := metrics.Labels{"remote": config.Redact(remote.Normalize(sv.s).URL.String())}
+	if !cloned {
+		sv.log.Info().Msgf("creating mirror %s", mirror.Path)
+		if err = mirror.CreateClone(ctx, *remote, cred, sv.log); err != nil {
+			return err
+		}
+		metrics.Default.Add(metrics.CacheMissesTotal, labels, 1)
+	} else {
+		sv.log.Info().Msgf("refreshing mirror %s", mirror.Path)
+		if err = mirror.UpdateClone(ctx, *remote, cred, sv.log); err != nil {
+			sv.log.Warn().Err(err).Msgf("serving stale mirror %s", mirror.Path)
+			return nil
+		}
+		metrics.Default.Add(metrics.CacheHitsTotal, labels, 1)
+	}
+	metrics.Default.Observe(metrics.FetchDuration, metrics.Labels{"remote": labels["remote"], "action": mirror.Action}, mirror.FetchDuration.Seconds())
+	metrics.Default.Add(metrics.FetchBytesTotal, labels, float64(mirror.BytesTransferred))
+	state.fetched = time.Now()
+	return nil
+}
+
+// upstreamScheme returns the scheme used to reach remotes
+func (sv *Server) upstreamScheme() string {
+	if sv.s.UpstreamScheme == "" {
+		return DefaultUpstreamScheme
+	}
+	return sv.s.UpstreamScheme
+}
+
+// credential returns a copy of the credential, refreshed if it is about to expire
+// The credential is shared by every mirror, so it's refreshed once for all of them
+func (sv *Server) credential() (types.Credential, error) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if err := sv.cred.Refresh(sv.log); err != nil {
+		return types.Credential{}, &types.Error{Class: types.ErrorClassCredential, Msg: "unable to refresh credential", Err: err}
+	}
+	return *sv.cred, nil
+}
+
+// markStale makes the next request for repo fetch the mirror
+func (sv *Server) markStale(repo string) {
+	mirror, err := sv.mirror(repo)
+	if err != nil {
+		return
+	}
+	sv.mu.Lock()
+	state, ok := sv.mirrors[mirror.Path]
+	sv.mu.Unlock()
+	// ensureMirror holds the mirror lock while it takes sv.mu. never hold both here
+	if ok {
+		state.Lock()
+		state.fetched = time.Time{}
+		state.Unlock()
+	}
+}
+
+// isDir returns true if p is a directory
+func isDir(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
+}
+
+// statusRecorder keeps the response status code for metrics and logs
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+// WriteHeader records the status code
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
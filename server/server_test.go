@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/types"
+	"github.com/rs/zerolog"
+)
+
+// git runs a git command and fails the test if it fails
+func git(t *testing.T, args ...string) {
+	t.Helper()
+	result, err := config.Run(context.Background(), append([]string{"git", "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...))
+	if err != nil || result.ReturnCode != 0 {
+		t.Fatalf("git %v: %s", args, result.String())
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		path, repo, endpoint string
+		ok                   bool
+	}{
+		{"/my.git.host/my/repo.git/info/refs", "my.git.host/my/repo.git", "info/refs", true},
+		{"/my.git.host:8443/scm/p/repo.git/git-upload-pack", "my.git.host:8443/scm/p/repo.git", "git-upload-pack", true},
+		{"/my.git.host/repo/objects/info/packs", "my.git.host/repo", "objects/info/packs", true},
+		{"/my.git.host/../etc/info/refs", "", "", false},
+		{"/repo.git/info/refs", "", "", false},
+		{"/my.git.host/repo.git", "", "", false},
+	}
+	for _, tt := range tests {
+		repo, endpoint, ok := parseRequest(tt.path)
+		if repo != tt.repo || endpoint != tt.endpoint || ok != tt.ok {
+			t.Errorf("parseRequest(%s) = %s, %s, %v", tt.path, repo, endpoint, ok)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	upstream := filepath.Join(dir, "upstream")
+	root := filepath.Join(dir, "mirror")
+	git(t, "init", "-q", "-b", "main", upstream)
+	git(t, "-C", upstream, "commit", "-q", "--allow-empty", "-m", "first")
+	git(t, "clone", "-q", "--mirror", upstream, filepath.Join(root, "my.git.host", "my", "repo.git"))
+	git(t, "clone", "-q", "--bare", upstream, types.NetworkStore(root, "abc"))
+
+	log := zerolog.New(os.Stderr)
+	ts := httptest.NewServer(New(config.Settings{Mirror: root}, nil, &log).Handler())
+	defer ts.Close()
+
+	local := filepath.Join(dir, "local")
+	git(t, "clone", "-q", ts.URL+"/my.git.host/my/repo.git", local)
+	git(t, "-C", local, "commit", "-q", "--allow-empty", "-m", "second")
+	result, _ := config.Run(context.Background(), []string{"git", "-C", local, "push", "-q", "origin", "main"})
+	if result.ReturnCode == 0 {
+		t.Errorf("push to the read-only mirror succeeded")
+	}
+
+	for path, want := range map[string]int{
+		"/my.git.host/my/missing.git/info/refs?service=git-upload-pack": http.StatusNotFound,
+		"/my.git.host/my/repo.git/info/refs?service=git-receive-pack":   http.StatusForbidden,
+		// network object stores have the refs of every fork
+		"/cache_clone.networks/abc.git/info/refs?service=git-upload-pack": http.StatusNotFound,
+		"/CACHE_CLONE.NETWORKS/abc.git/info/refs?service=git-upload-pack": http.StatusNotFound,
+		"/cache_clone.networks/abc.git/HEAD":                              http.StatusNotFound,
+		"/healthz":                                                        http.StatusOK,
+		"/metrics":                                                        http.StatusOK,
+	} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestForwardPush(t *testing.T) {
+	var got string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, token, _ := r.BasicAuth()
+		got = r.Method + " " + r.URL.String() + " " + user + ":" + token
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	log := zerolog.New(io.Discard)
+	s := config.Settings{Mirror: t.TempDir(), Remote: upstream.URL + "/org/repo.git", UpstreamScheme: "http", ForwardPush: true}
+	ts := httptest.NewServer(New(s, &types.Credential{Username: "bob", Token: "secret"}, &log).Handler())
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/"+host+"/org/repo.git/git-receive-pack", strings.NewReader("pack"))
+	req.SetBasicAuth("client", "ignored")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := "POST /org/repo.git/git-receive-pack bob:secret"; resp.StatusCode != http.StatusOK || got != want {
+		t.Errorf("forwarded %d %q, want %q", resp.StatusCode, got, want)
+	}
+
+	// other hosts never get the credential
+	resp, err = http.Post(ts.URL+"/other.host/org/repo.git/git-receive-pack", "application/x-git-receive-pack-request", strings.NewReader("pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("push to other host = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,149 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	statusOK         = 1
+	statusError      = 2
+)
+
+type otlpValue map[string]interface{}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// Document returns the spans as an OTLP ExportTraceServiceRequest JSON document
+func Document(spans []*Span, serviceVersion string) ([]byte, error) {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		status := otlpStatus{Code: statusOK}
+		if s.Err != nil {
+			status = otlpStatus{Code: statusError, Message: s.Err.Error()}
+		}
+		out = append(out, otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        attributes(s.Attributes),
+			Status:            status,
+		})
+	}
+	resource := attributes(map[string]interface{}{
+		"service.name":    "cache_clone",
+		"service.version": serviceVersion,
+	})
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": resource},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/natemarks/cache_clone"},
+				"spans": out,
+			}},
+		}},
+	})
+}
+
+// attributes converts a map to sorted OTLP attributes
+func attributes(m map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]otlpAttribute, 0, len(keys))
+	for _, k := range keys {
+		var v otlpValue
+		switch t := m[k].(type) {
+		case string:
+			v = otlpValue{"stringValue": t}
+		case bool:
+			v = otlpValue{"boolValue": t}
+		case int:
+			v = otlpValue{"intValue": strconv.Itoa(t)}
+		case int64:
+			v = otlpValue{"intValue": strconv.FormatInt(t, 10)}
+		case float64:
+			v = otlpValue{"doubleValue": t}
+		case time.Duration:
+			v = otlpValue{"doubleValue": t.Seconds()}
+		case []string:
+			values := make([]otlpValue, 0, len(t))
+			for _, s := range t {
+				values = append(values, otlpValue{"stringValue": s})
+			}
+			v = otlpValue{"arrayValue": map[string]interface{}{"values": values}}
+		default:
+			v = otlpValue{"stringValue": fmt.Sprint(t)}
+		}
+		out = append(out, otlpAttribute{Key: k, Value: v})
+	}
+	return out
+}
+
+// export writes the spans to the configured file and endpoint
+func export(c Config, spans []*Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	doc, err := Document(spans, c.ServiceVersion)
+	if err != nil {
+		return err
+	}
+	if c.File != "" {
+		if err = os.WriteFile(c.File, append(doc, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	if c.Endpoint == "" {
+		return nil
+	}
+	endpoint := strings.TrimSuffix(c.Endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(doc))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("OTLP export to %s failed: %s", endpoint, resp.Status)
+	}
+	return nil
+}
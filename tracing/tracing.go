@@ -0,0 +1,172 @@
+// Package tracing records the phases of a cache_clone run as OpenTelemetry spans
+// Spans are exported when the run finishes, as OTLP/HTTP JSON to a collector
+// or as the same JSON document to a local file
+//
+// The current span is passed in a context.Context, so concurrent operations in
+// serve and daemon don't get each other's spans as parents
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentEnv is the W3C trace context variable CI systems set for child processes
+const TraceParentEnv = "TRACEPARENT"
+
+// Span is a timed operation
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Err        error
+	t          *tracerState
+}
+
+// SetAttribute adds an attribute. It does nothing if tracing is disabled
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// Finish ends the span and records err as its status
+// It does nothing if tracing is disabled
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	t := s.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.End = time.Now()
+	s.Err = err
+	t.finished = append(t.finished, s)
+}
+
+// Config is where spans are exported
+type Config struct {
+	// OTLP/HTTP endpoint. ex. http://localhost:4318
+	Endpoint string
+	// local file for the OTLP JSON document
+	File string
+	// resource attributes
+	ServiceVersion string
+}
+
+type tracerState struct {
+	mu       sync.Mutex
+	config   Config
+	traceID  string
+	parentID string
+	finished []*Span
+}
+
+// tracer is nil until Init enables tracing
+var tracer *tracerState
+
+// Init enables tracing if an endpoint or file is configured
+// The trace continues the one in TRACEPARENT when it is set
+func Init(c Config) error {
+	if c.Endpoint == "" && c.File == "" {
+		tracer = nil
+		return nil
+	}
+	t := &tracerState{config: c, traceID: newID(16)}
+	if parent := os.Getenv(TraceParentEnv); parent != "" {
+		traceID, spanID, err := ParseTraceParent(parent)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", TraceParentEnv, err)
+		}
+		t.traceID, t.parentID = traceID, spanID
+	}
+	tracer = t
+	return nil
+}
+
+// Enabled returns true if spans are being recorded
+func Enabled() bool {
+	return tracer != nil
+}
+
+// spanKey is the context key of the current span
+type spanKey struct{}
+
+// Start starts a span as a child of the span in ctx, or of TRACEPARENT without one
+// It returns a context with the new span for its children. The span is nil if
+// tracing is disabled. nil spans are safe to use
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	t := tracer
+	if t == nil {
+		return ctx, nil
+	}
+	parent := t.parentID
+	// a span of an earlier trace isn't a parent
+	if p := FromContext(ctx); p != nil && p.t == t {
+		parent = p.SpanID
+	}
+	s := &Span{
+		TraceID:    t.traceID,
+		SpanID:     newID(8),
+		ParentID:   parent,
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+		t:          t,
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext returns the current span in ctx, or nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Shutdown exports the finished spans and disables tracing
+func Shutdown() error {
+	t := tracer
+	if t == nil {
+		return nil
+	}
+	tracer = nil
+	t.mu.Lock()
+	spans := t.finished
+	t.mu.Unlock()
+	return export(t.config, spans)
+}
+
+// ParseTraceParent returns the trace and parent span ids of a W3C traceparent
+// ex. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ParseTraceParent(value string) (traceID, spanID string, err error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", fmt.Errorf("expected version-traceid-spanid-flags: %s", value)
+	}
+	for _, id := range parts[1:3] {
+		if _, err := hex.DecodeString(id); err != nil || strings.Trim(id, "0") == "" {
+			return "", "", fmt.Errorf("invalid id in traceparent: %s", value)
+		}
+	}
+	return parts[1], parts[2], nil
+}
+
+// newID returns a random hex id of n bytes
+func newID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,97 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestSpans checks span nesting, the TRACEPARENT parent and the exported file
+func TestSpans(t *testing.T) {
+	t.Setenv(TraceParentEnv, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	file := filepath.Join(t.TempDir(), "trace.json")
+	if err := Init(Config{File: file}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, root := Start(context.Background(), "root")
+	_, child := Start(ctx, "child")
+	child.SetAttribute("process.exit_code", 128)
+	child.Finish(errors.New("failed"))
+	root.Finish(nil)
+	if err := Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if _, s := Start(ctx, "disabled"); s != nil {
+		t.Errorf("Start should return nil after Shutdown")
+	}
+
+	if root.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || root.ParentID != "00f067aa0ba902b7" {
+		t.Errorf("root span should continue TRACEPARENT: %s %s", root.TraceID, root.ParentID)
+	}
+	if child.ParentID != root.SpanID {
+		t.Errorf("child parent = %s, want %s", child.ParentID, root.SpanID)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	spans := doc.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 || spans[0].Name != "child" || spans[0].Status.Code != statusError {
+		t.Errorf("unexpected spans: %+v", spans)
+	}
+}
+
+// TestConcurrentSpans checks that spans started at the same time in different
+// goroutines are children of the span in their own context
+func TestConcurrentSpans(t *testing.T) {
+	t.Setenv(TraceParentEnv, "")
+	if err := Init(Config{File: filepath.Join(t.TempDir(), "trace.json")}); err != nil {
+		t.Fatal(err)
+	}
+	defer Shutdown()
+	root, daemon := Start(context.Background(), "daemon")
+	var wg sync.WaitGroup
+	started := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, update := Start(root, "mirror.update")
+			<-started
+			_, fetch := Start(ctx, "git fetch")
+			// a sibling finishing first doesn't change the parent
+			fetch.Finish(nil)
+			update.Finish(nil)
+			if fetch.ParentID != update.SpanID || update.ParentID != daemon.SpanID {
+				t.Errorf("fetch parent = %s, update parent = %s, want %s and %s", fetch.ParentID, update.ParentID, update.SpanID, daemon.SpanID)
+			}
+		}()
+	}
+	close(started)
+	wg.Wait()
+	daemon.Finish(nil)
+}
+
+// TestParseTraceParent rejects malformed values
+func TestParseTraceParent(t *testing.T) {
+	for _, v := range []string{"", "00-abc-def-01", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"} {
+		if _, _, err := ParseTraceParent(v); err == nil {
+			t.Errorf("ParseTraceParent(%q) should fail", v)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package types
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awscfg "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/natemarks/cache_clone/config"
+	"github.com/rs/zerolog"
+)
+
+// endpointRegion is the signing region used with a custom endpoint when no region
+// is configured. local Secrets Manager stand-ins accept any region
+const endpointRegion = "us-east-1"
+
+// LoadAWSConfig returns the AWS config for the region, profile and role in the settings
+// Without any of them this is the same as the SDK default chain (env vars, shared config, instance role)
+func LoadAWSConfig(s config.Settings, log *zerolog.Logger) (aws.Config, error) {
+	return loadAWSConfig(s, log)
+}
+
+// loadAWSConfig is LoadAWSConfig with options for the STS client that assumes the role
+func loadAWSConfig(s config.Settings, log *zerolog.Logger, stsOpts ...func(*sts.Options)) (aws.Config, error) {
+	var opts []func(*awscfg.LoadOptions) error
+	if s.AWSRegion != "" {
+		log.Debug().Msgf("using AWS region: %s", s.AWSRegion)
+		opts = append(opts, awscfg.WithRegion(s.AWSRegion))
+	} else if s.AWSEndpointURL != "" {
+		opts = append(opts, awscfg.WithDefaultRegion(endpointRegion))
+	}
+	if s.AWSProfile != "" {
+		log.Debug().Msgf("using AWS profile: %s", s.AWSProfile)
+		opts = append(opts, awscfg.WithSharedConfigProfile(s.AWSProfile))
+	}
+	cfg, err := awscfg.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if s.AWSRoleARN == "" {
+		return cfg, nil
+	}
+
+	// the base credentials are only used to assume the role
+	log.Debug().Msgf("assuming AWS role: %s", s.AWSRoleARN)
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg, stsOpts...), s.AWSRoleARN,
+		func(o *stscreds.AssumeRoleOptions) {
+			if s.AWSExternalID != "" {
+				o.ExternalID = aws.String(s.AWSExternalID)
+			}
+			if s.AWSSessionName != "" {
+				o.RoleSessionName = s.AWSSessionName
+			}
+		})
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+	return cfg, nil
+}
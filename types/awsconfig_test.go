@@ -0,0 +1,126 @@
+package types
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/natemarks/cache_clone/config"
+	"github.com/rs/zerolog"
+)
+
+// awsEnv replaces the AWS environment with static keys and no shared config
+func awsEnv(t *testing.T, key string) {
+	dir := t.TempDir()
+	t.Setenv("AWS_ACCESS_KEY_ID", key)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	for _, name := range []string{"AWS_SESSION_TOKEN", "AWS_REGION", "AWS_DEFAULT_REGION", "AWS_PROFILE", "AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+}
+
+// TestLoadAWSConfig reads a secret from a Secrets Manager stand-in and checks the
+// region and access key it was signed with
+func TestLoadAWSConfig(t *testing.T) {
+	log := zerolog.Nop()
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Write([]byte(`{"Name":"x","SecretString":"{}"}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		settings config.Settings
+		profile  bool
+		// the credential scope in the signature
+		want string
+	}{
+		{"endpoint without a region", config.Settings{}, false, "Credential=ENVKEY/*/us-east-1/secretsmanager/"},
+		{"region", config.Settings{AWSRegion: "eu-west-2"}, false, "Credential=ENVKEY/*/eu-west-2/secretsmanager/"},
+		{"profile", config.Settings{AWSProfile: "ci"}, true, "Credential=PROFILEKEY/*/ap-south-1/secretsmanager/"},
+		{"profile and region", config.Settings{AWSProfile: "ci", AWSRegion: "eu-west-2"}, true, "Credential=PROFILEKEY/*/eu-west-2/secretsmanager/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			awsEnv(t, "ENVKEY")
+			if tt.profile {
+				if err := os.WriteFile(os.Getenv("AWS_CONFIG_FILE"), []byte("[profile ci]\nregion = ap-south-1\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(os.Getenv("AWS_SHARED_CREDENTIALS_FILE"),
+					[]byte("[ci]\naws_access_key_id = PROFILEKEY\naws_secret_access_key = secret\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s := tt.settings
+			s.AWSEndpointURL = srv.URL
+			s.SecretID = "x"
+			auth = ""
+			if _, err := getSecretDoc(s, &log); err != nil {
+				t.Fatal(err)
+			}
+			prefix, rest, _ := strings.Cut(tt.want, "*")
+			if !strings.Contains(auth, prefix) || !strings.Contains(auth, rest) {
+				t.Errorf("Authorization = %q, want %s", auth, tt.want)
+			}
+		})
+	}
+}
+
+// TestLoadAWSConfigRole assumes a role through an STS stand-in
+func TestLoadAWSConfigRole(t *testing.T) {
+	log := zerolog.Nop()
+	awsEnv(t, "ENVKEY")
+	var form, auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		form = r.PostForm.Encode()
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<AssumeRoleResult><Credentials>
+<AccessKeyId>ROLEKEY</AccessKeyId><SecretAccessKey>rolesecret</SecretAccessKey>
+<SessionToken>session</SessionToken><Expiration>2099-01-01T00:00:00Z</Expiration>
+</Credentials></AssumeRoleResult></AssumeRoleResponse>`))
+	}))
+	defer srv.Close()
+
+	s := config.Settings{
+		AWSRegion:      "eu-west-2",
+		AWSRoleARN:     "arn:aws:iam::123456789012:role/reader",
+		AWSExternalID:  "ext",
+		AWSSessionName: "cache-clone-ci",
+	}
+	cfg, err := loadAWSConfig(s, &log, sts.WithEndpointResolver(sts.EndpointResolverFromURL(srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "ROLEKEY" || creds.SessionToken != "session" {
+		t.Errorf("credentials = %+v, want the assumed role", creds)
+	}
+	// the base credentials only sign the AssumeRole call
+	if !strings.Contains(auth, "Credential=ENVKEY/") {
+		t.Errorf("AssumeRole Authorization = %q", auth)
+	}
+	for _, want := range []string{"Action=AssumeRole", "ExternalId=ext", "RoleSessionName=cache-clone-ci", "RoleArn=arn%3Aaws%3Aiam%3A%3A123456789012%3Arole%2Freader"} {
+		if !strings.Contains(form, want) {
+			t.Errorf("AssumeRole form %q is missing %s", form, want)
+		}
+	}
+}
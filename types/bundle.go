@@ -0,0 +1,258 @@
+package types
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/tracing"
+	"github.com/rs/zerolog"
+)
+
+// bundledFile is modified after each bundle upload. git ignores it
+const bundledFile = "cache_clone.bundled"
+
+// ManifestFile lists the bundles in an export directory
+const ManifestFile = "manifest.json"
+
+// Manifest describes the bundles written by an export
+type Manifest struct {
+	Created time.Time    `json:"created"`
+	Bundles []BundleMeta `json:"bundles"`
+}
+
+// ReadManifest reads the manifest in an export directory
+func ReadManifest(dir string) (Manifest, error) {
+	var manifest Manifest
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return manifest, &Error{Class: ErrorClassFilesystem, Msg: "unable to read bundle manifest", Err: err}
+	}
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return manifest, &Error{Class: ErrorClassFilesystem, Msg: "invalid bundle manifest", Err: err}
+	}
+	return manifest, nil
+}
+
+// Write writes the manifest to an export directory
+func (mf Manifest) Write(dir string) error {
+	data, err := json.MarshalIndent(mf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(dir, ManifestFile), append(data, '\n'), 0644); err != nil {
+		return &Error{Class: ErrorClassFilesystem, Msg: "unable to write bundle manifest", Err: err}
+	}
+	return nil
+}
+
+// ExportBundle writes the mirror to <dir>/<host>/<path>.bundle and returns its manifest entry
+func (m *Mirror) ExportBundle(ctx context.Context, dir string) (BundleMeta, error) {
+	remote, err := m.Remote(ctx)
+	if err != nil {
+		return BundleMeta{}, err
+	}
+	file := path.Join(remote.Host, strings.Trim(remote.Path, "/")) + ".bundle"
+	p := filepath.Join(dir, filepath.FromSlash(file))
+	if err = os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return BundleMeta{}, &Error{Class: ErrorClassFilesystem, Msg: "unable to create export directory", Err: err}
+	}
+	meta, err := m.CreateBundle(ctx, p)
+	if err != nil {
+		return BundleMeta{}, err
+	}
+	meta.Remote = remote.URL.String()
+	meta.File = file
+	return meta, nil
+}
+
+// ImportBundle creates the mirror from an exported bundle, or updates it to the bundle refs
+// Refs that aren't in the bundle are deleted, like a fetch from the remote would.
+// The mirror counts as fetched, so clone --max-age uses it without the remote
+func (m *Mirror) ImportBundle(ctx context.Context, dir string, meta BundleMeta, log *zerolog.Logger) (err error) {
+	ctx, span := tracing.Start(ctx, "mirror.bundle_import")
+	defer func() { m.finishSpan(span, err) }()
+	if !filepath.IsLocal(filepath.FromSlash(meta.File)) {
+		return &Error{Class: ErrorClassFilesystem, Msg: "bundle file " + meta.File + " is outside the export directory"}
+	}
+	p := filepath.Join(dir, filepath.FromSlash(meta.File))
+	sum, _, err := fileSHA256(p)
+	if err != nil {
+		return &Error{Class: ErrorClassFilesystem, Msg: "unable to read bundle " + p, Err: err}
+	}
+	if sum != meta.SHA256 {
+		return &Error{Class: ErrorClassFilesystem, Msg: "bundle " + p + " checksum " + sum + " doesn't match the manifest"}
+	}
+	start := time.Now()
+	if m.CheckClone(ctx, log) {
+		before := m.refs(ctx)
+		result, err := config.Run(ctx, []string{"git", "-C", m.Path, "fetch", "--prune", "--", p, "+refs/*:refs/*"})
+		if err != nil || result.ReturnCode != 0 {
+			return gitError("unable to import bundle "+p, result, err)
+		}
+		m.Action = MirrorUpdated
+		if m.refs(ctx) == before {
+			m.Action = MirrorReused
+		}
+	} else {
+		if err = m.Perms.MkdirAll(path.Dir(m.Path)); err != nil {
+			return &Error{Class: ErrorClassFilesystem, Msg: "unable to create mirror parent " + path.Dir(m.Path), Err: err}
+		}
+		if err = m.cloneBundle(ctx, p); err != nil {
+			return err
+		}
+		// fetches go to the remote once it can be reached
+		result, err := config.Run(ctx, []string{"git", "-C", m.Path, "remote", "set-url", "--", "origin", meta.Remote})
+		if err != nil || result.ReturnCode != 0 {
+			return gitError("unable to set mirror remote URL", result, err)
+		}
+		m.Action = MirrorCreated
+		if err := m.recordIndex(); err != nil {
+			log.Warn().Err(err).Msgf("unable to add %s to the mirror index", m.Path)
+		}
+		if err := m.JoinNetwork(ctx, log); err != nil {
+			log.Warn().Err(err).Msgf("unable to add %s to fork network %s", m.Path, m.Network)
+		}
+	}
+	m.FetchDuration = time.Since(start)
+	if m.Perms.SharedRepository() != "" {
+		if err = m.Perms.ChmodTree(m.Path); err != nil {
+			return &Error{Class: ErrorClassFilesystem, Msg: "unable to set mirror permissions", Err: err}
+		}
+	}
+	if err := m.markFetched(); err != nil {
+		log.Warn().Err(err).Msgf("unable to record fetch time of %s", m.Path)
+	}
+	m.IsCloned = true
+	return nil
+}
+
+// CreateBundle writes every mirror ref and the objects they need to a git bundle file
+func (m *Mirror) CreateBundle(ctx context.Context, p string) (BundleMeta, error) {
+	refs, err := m.refValues(ctx)
+	if err != nil {
+		return BundleMeta{}, err
+	}
+	// bundle create takes rev-list options after the file, so it can't follow --
+	if p, err = filepath.Abs(p); err != nil {
+		return BundleMeta{}, &Error{Class: ErrorClassFilesystem, Msg: "invalid bundle path", Err: err}
+	}
+	result, err := config.Run(ctx, []string{"git", "-C", m.Path, "bundle", "create", p, "--all"})
+	if err != nil || result.ReturnCode != 0 {
+		return BundleMeta{}, gitError("unable to bundle mirror "+m.Path, result, err)
+	}
+	sum, size, err := fileSHA256(p)
+	if err != nil {
+		return BundleMeta{}, &Error{Class: ErrorClassFilesystem, Msg: "unable to read bundle " + p, Err: err}
+	}
+	return BundleMeta{Created: time.Now().UTC(), Refs: refs, SHA256: sum, Size: size}, nil
+}
+
+// UploadBundle bundles the mirror and uploads it to the bundle store
+// Only the newest keep bundles of the remote are kept
+func (m *Mirror) UploadBundle(ctx context.Context, r HTTPSRemote, keep int, log *zerolog.Logger) (err error) {
+	ctx, span := tracing.Start(ctx, "mirror.bundle_upload")
+	span.SetAttribute("mirror.path", m.Path)
+	defer func() { span.Finish(err) }()
+	if m.Bundles == nil {
+		return nil
+	}
+	tmp, err := os.MkdirTemp("", "cache_clone_bundle")
+	if err != nil {
+		return &Error{Class: ErrorClassFilesystem, Msg: "unable to create bundle directory", Err: err}
+	}
+	defer os.RemoveAll(tmp)
+	p := filepath.Join(tmp, "mirror.bundle")
+	meta, err := m.CreateBundle(ctx, p)
+	if err != nil {
+		return err
+	}
+	meta.Remote = config.Redact(r.URL.String())
+	if err = m.Bundles.Upload(r, p, meta, keep); err != nil {
+		return &Error{Class: ErrorClassNetwork, Msg: "unable to upload bundle of " + m.Path, Err: config.RedactError(err)}
+	}
+	log.Info().Msgf("uploaded bundle of %s (%d bytes)", m.Path, meta.Size)
+	return m.touchStamp(bundledFile)
+}
+
+// LastBundled returns when the mirror was last uploaded to the bundle store
+func (m *Mirror) LastBundled() (time.Time, error) {
+	info, err := os.Stat(filepath.Join(m.Path, bundledFile))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// bootstrap creates the mirror from the newest bundle of the remote in the bundle store
+// It returns false when there is no usable bundle, leaving nothing behind, so the
+// caller clones from the remote instead
+func (m *Mirror) bootstrap(ctx context.Context, r HTTPSRemote, log *zerolog.Logger) bool {
+	if m.Bundles == nil {
+		return false
+	}
+	meta, err := m.Bundles.Latest(r)
+	if err != nil {
+		log.Warn().Err(config.RedactError(err)).Msg("unable to find a mirror bundle. cloning from the remote")
+		return false
+	}
+	if meta == nil {
+		log.Debug().Msgf("no bundle of %s", config.Redact(r.URL.String()))
+		return false
+	}
+	tmp, err := os.MkdirTemp(path.Dir(m.Path), ".cache_clone_bundle")
+	if err != nil {
+		log.Warn().Err(err).Msg("unable to create bundle directory. cloning from the remote")
+		return false
+	}
+	defer os.RemoveAll(tmp)
+	p := filepath.Join(tmp, "mirror.bundle")
+	if err = m.Bundles.Download(*meta, p); err != nil {
+		log.Warn().Err(config.RedactError(err)).Msg("unable to download mirror bundle. cloning from the remote")
+		return false
+	}
+	if err = m.cloneBundle(ctx, p); err != nil {
+		log.Warn().Err(err).Msg("unable to clone mirror bundle. cloning from the remote")
+		os.RemoveAll(m.Path)
+		return false
+	}
+	log.Info().Msgf("created mirror %s from bundle %s", m.Path, meta.Key)
+	m.Bundle = meta.Key
+	return true
+}
+
+// cloneBundle creates the mirror from a bundle file
+func (m *Mirror) cloneBundle(ctx context.Context, p string) error {
+	args := []string{"git", "-C", path.Dir(m.Path), "clone", "--mirror"}
+	if shared := m.Perms.SharedRepository(); shared != "" {
+		args = append(args, "--config", "core.sharedRepository="+shared)
+	}
+	result, err := config.Run(ctx, append(args, "--", p, m.Path))
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to clone bundle "+p, result, err)
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex SHA-256 and size of a file
+func fileSHA256(p string) (string, int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
@@ -0,0 +1,298 @@
+package types
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/natemarks/cache_clone/config"
+	"github.com/rs/zerolog"
+)
+
+// bundleTimeFormat names bundles so the newest sorts last
+const bundleTimeFormat = "20060102T150405Z"
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// BundleMeta describes a mirror bundle in the bundle store
+// It is uploaded after the bundle, so a bundle is complete once its metadata exists
+type BundleMeta struct {
+	Remote  string            `json:"remote"`
+	Created time.Time         `json:"created"`
+	Refs    map[string]string `json:"refs"`
+	SHA256  string            `json:"sha256"`
+	Size    int64             `json:"size"`
+	// object key of the bundle in the bundle store
+	Key string `json:"key,omitempty"`
+	// bundle file relative to the manifest of an export
+	File string `json:"file,omitempty"`
+}
+
+// BundleStore keeps mirror bundles in an S3-compatible bucket
+// Objects are addressed path style (endpoint/bucket/key) so MinIO and other
+// stand-ins work without DNS for the bucket
+type BundleStore struct {
+	s   config.Settings
+	log *zerolog.Logger
+
+	once   sync.Once
+	cfg    aws.Config
+	cfgErr error
+}
+
+// NewBundleStore returns the bundle store in the settings, or nil if there is none
+// The AWS config is loaded on first use
+func NewBundleStore(s config.Settings, log *zerolog.Logger) *BundleStore {
+	if s.BundleBucket == "" {
+		return nil
+	}
+	return &BundleStore{s: s, log: log}
+}
+
+// bundleDir returns the key prefix of the bundles of a remote
+// ex. prefix/my.git.host/my/repo.git/
+func (b *BundleStore) bundleDir(r HTTPSRemote) string {
+	parts := []string{strings.Trim(b.s.BundlePrefix, "/"), r.Host, strings.Trim(r.Path, "/")}
+	var kept []string
+	for _, p := range parts {
+		if p != "" {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, "/") + "/"
+}
+
+// Latest returns the metadata of the newest bundle of a remote, or nil if there is none
+func (b *BundleStore) Latest(r HTTPSRemote) (*BundleMeta, error) {
+	keys, err := b.list(b.bundleDir(r))
+	if err != nil {
+		return nil, err
+	}
+	var metas []string
+	for _, k := range keys {
+		if strings.HasSuffix(k, ".json") {
+			metas = append(metas, k)
+		}
+	}
+	if len(metas) == 0 {
+		return nil, nil
+	}
+	sort.Strings(metas)
+	body, err := b.get(metas[len(metas)-1])
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var meta BundleMeta
+	if err = json.NewDecoder(body).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("unable to read bundle metadata %s: %w", metas[len(metas)-1], err)
+	}
+	return &meta, nil
+}
+
+// Download writes the bundle to a file and checks its checksum
+func (b *BundleStore) Download(meta BundleMeta, p string) error {
+	body, err := b.get(meta.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(f, hash), body); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != meta.SHA256 {
+		return fmt.Errorf("bundle %s checksum %s doesn't match %s", meta.Key, sum, meta.SHA256)
+	}
+	return nil
+}
+
+// Upload stores a bundle file and its metadata, then drops all but the newest keep bundles
+// meta.Key is set from the remote and the creation time
+func (b *BundleStore) Upload(r HTTPSRemote, p string, meta BundleMeta, keep int) error {
+	base := b.bundleDir(r) + meta.Created.UTC().Format(bundleTimeFormat)
+	meta.Key = base + ".bundle"
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = b.put(meta.Key, f, meta.Size, meta.SHA256); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(data)
+	if err = b.put(base+".json", strings.NewReader(string(data)), int64(len(data)), hex.EncodeToString(hash[:])); err != nil {
+		return err
+	}
+	return b.prune(r, keep)
+}
+
+// prune deletes all but the newest keep bundles of a remote
+func (b *BundleStore) prune(r HTTPSRemote, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	keys, err := b.list(b.bundleDir(r))
+	if err != nil {
+		return err
+	}
+	var metas []string
+	for _, k := range keys {
+		if strings.HasSuffix(k, ".json") {
+			metas = append(metas, k)
+		}
+	}
+	sort.Strings(metas)
+	for len(metas) > keep {
+		base := strings.TrimSuffix(metas[0], ".json")
+		// the metadata goes first so the bundle is never listed without its file
+		for _, k := range []string{base + ".json", base + ".bundle"} {
+			if err = b.delete(k); err != nil {
+				return err
+			}
+		}
+		metas = metas[1:]
+	}
+	return nil
+}
+
+// listResult is the part of an S3 ListObjectsV2 response that is used
+type listResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list returns the object keys that start with prefix
+func (b *BundleStore) list(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := b.do(http.MethodGet, "", query, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to list bundles: %w", err)
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// get returns the body of an object. The caller closes it
+func (b *BundleStore) get(key string) (io.ReadCloser, error) {
+	resp, err := b.do(http.MethodGet, key, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// put uploads an object with its SHA-256 so the store can check it
+func (b *BundleStore) put(key string, body io.Reader, size int64, sha string) error {
+	resp, err := b.do(http.MethodPut, key, nil, body, size, sha)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// delete removes an object
+func (b *BundleStore) delete(key string) error {
+	resp, err := b.do(http.MethodDelete, key, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a SigV4 signed request for the bucket or an object in it
+// Responses other than 2xx are returned as errors
+func (b *BundleStore) do(method, key string, query url.Values, body io.Reader, size int64, sha string) (*http.Response, error) {
+	b.once.Do(func() { b.cfg, b.cfgErr = LoadAWSConfig(b.s, b.log) })
+	if b.cfgErr != nil {
+		return nil, b.cfgErr
+	}
+	region := b.cfg.Region
+	if region == "" {
+		region = endpointRegion
+	}
+	endpoint := b.s.BundleEndpointURL
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + b.s.BundleBucket)
+	if err != nil {
+		return nil, err
+	}
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("X-Amz-Content-Sha256", sha)
+	if b.cfg.Credentials == nil {
+		return nil, fmt.Errorf("no AWS credentials for the bundle store")
+	}
+	creds, err := b.cfg.Credentials.Retrieve(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("unable to get AWS credentials: %w", err)
+	}
+	if err = v4.NewSigner().SignHTTP(context.TODO(), creds, req, sha, "s3", region, time.Now()); err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, u.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
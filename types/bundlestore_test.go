@@ -0,0 +1,138 @@
+package types
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/rs/zerolog"
+)
+
+// fakeS3 is an S3-compatible stand-in for one bucket
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/bucket":
+		var result listResult
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			result.Contents = append(result.Contents, struct {
+				Key string `xml:"Key"`
+			}{k})
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = data
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func git(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestBundleStore(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "a")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "b")
+	t.Setenv("AWS_REGION", "us-east-1")
+	fake := &fakeS3{objects: map[string][]byte{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	log := zerolog.Nop()
+	store := NewBundleStore(config.Settings{BundleBucket: "bucket", BundlePrefix: "mirrors", BundleEndpointURL: srv.URL}, &log)
+	remote := NewHTTPSRemote("https://my.git.host/org/repo.git")
+
+	// a source mirror with one commit
+	work := t.TempDir()
+	git(t, "-C", work, "init", "-q")
+	git(t, "-C", work, "-c", "user.name=a", "-c", "user.email=a@b", "commit", "-q", "--allow-empty", "-m", "one")
+	source := &Mirror{Path: filepath.Join(t.TempDir(), "source.git")}
+	git(t, "clone", "-q", "--mirror", work, source.Path)
+
+	if meta, err := store.Latest(*remote); err != nil || meta != nil {
+		t.Fatalf("Latest() = %v, %v before any upload", meta, err)
+	}
+	for i := 0; i < 3; i++ {
+		p := filepath.Join(t.TempDir(), "mirror.bundle")
+		meta, err := source.CreateBundle(context.Background(), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta.Created = meta.Created.Add(time.Duration(i) * time.Hour)
+		if err = store.Upload(*remote, p, meta, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := store.list("mirrors/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 4 {
+		t.Errorf("%d objects after upload, want 2 bundles and their metadata: %v", len(keys), keys)
+	}
+
+	m := &Mirror{Path: filepath.Join(t.TempDir(), "my.git.host", "org", "repo.git"), Bundles: store}
+	if err = m.Perms.MkdirAll(filepath.Dir(m.Path)); err != nil {
+		t.Fatal(err)
+	}
+	if !m.bootstrap(context.Background(), *remote, &log) {
+		t.Fatal("bootstrap() = false")
+	}
+	if !strings.HasPrefix(m.Bundle, "mirrors/my.git.host/org/repo.git/") {
+		t.Errorf("Bundle = %s", m.Bundle)
+	}
+	want, _ := source.refValues(context.Background())
+	if got, _ := m.refValues(context.Background()); !reflect.DeepEqual(got, want) {
+		t.Errorf("bootstrapped refs = %v, want %v", got, want)
+	}
+
+	// a corrupt bundle is refused
+	meta, _ := store.Latest(*remote)
+	fake.objects[meta.Key] = []byte("corrupt")
+	if err = store.Download(*meta, filepath.Join(t.TempDir(), "mirror.bundle")); err == nil {
+		t.Error("Download() of a corrupt bundle succeeded")
+	}
+}
@@ -2,18 +2,43 @@ package types
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	awscfg "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/tracing"
 	"github.com/rs/zerolog"
 )
 
+// DefaultSecretUsername is the username used with plaintext (token only) secrets
+// when no username is configured. GitHub and most token based servers accept it
+const DefaultSecretUsername = "x-access-token"
+
+// Credential types
+const (
+	// BasicCredential is a username and token sent in an Authorization: Basic header
+	BasicCredential = "basic"
+	// BearerCredential is a token sent in an Authorization: Bearer header
+	BearerCredential = "bearer"
+	// GitHubAppCredential is an installation token minted from a GitHub App private key
+	GitHubAppCredential = "github-app"
+)
+
+// credentialRefreshWindow is how long before expiry a token is replaced
+const credentialRefreshWindow = 5 * time.Minute
+
 // Credential is a struct that represents a credential
 // store the sha256sums for logging/debugging purposes
 type Credential struct {
+	// One of BasicCredential, BearerCredential or GitHubAppCredential
+	Type string
 	//The sha256sum of the AWS SM secret json document
 	SecretSha256sum string
 	// Remote username
@@ -24,54 +49,324 @@ type Credential struct {
 	Token string
 	// Sha256sum of the remote token
 	TokenSha256sum string
+	// When the token expires. zero if it doesn't
+	Expiry time.Time
+	// returns a replacement for an expiring token
+	refresh func() (*Credential, error)
 }
 
 // NewCredential creates a new Credential struct
 func NewCredential(s config.Settings, log *zerolog.Logger) *Credential {
+	c, err := LoadCredential(context.Background(), s, log)
+	if err != nil {
+		log.Fatal().Err(err).Msg(err.Error())
+	}
+	return c
+}
+
+// LoadCredential reads the secret and builds the credential for s.CredentialType
+func LoadCredential(ctx context.Context, s config.Settings, log *zerolog.Logger) (*Credential, error) {
+	_, span := tracing.Start(ctx, "credential.load")
+	span.SetAttribute("credential.type", s.CredentialType)
+	c, err := loadCredential(s, log)
+	if err != nil {
+		err = &Error{Class: ErrorClassCredential, Msg: "unable to load credential", Err: config.RedactError(err)}
+		span.Finish(err)
+		return nil, err
+	}
+	span.Finish(nil)
+	return c, nil
+}
+
+// loadCredential reads the secret and builds the credential for s.CredentialType
+func loadCredential(s config.Settings, log *zerolog.Logger) (*Credential, error) {
+	doc, err := getSecretDoc(s, log)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Msgf("SecretJSON Document(sha256): %s", config.Sha256sum(string(doc)))
+
+	var c *Credential
+	switch s.CredentialType {
+	case "", BasicCredential:
+		log.Debug().Msg("parsing credentials from AWSSM secret doc")
+		username, token, err := ParseSecret(doc, s)
+		if err != nil {
+			return nil, err
+		}
+		c = &Credential{Type: BasicCredential, Username: username, Token: token}
+	case BearerCredential:
+		log.Debug().Msg("parsing bearer token from AWSSM secret doc")
+		c, err = parseBearer(doc, s)
+		if err != nil {
+			return nil, err
+		}
+		// bearer tokens are refreshed by reading the secret again
+		c.refresh = func() (*Credential, error) { return loadCredential(s, log) }
+	case GitHubAppCredential:
+		log.Debug().Msg("minting GitHub App installation token")
+		app, err := ParseGitHubApp(doc, s)
+		if err != nil {
+			return nil, err
+		}
+		c, err = app.InstallationToken(log)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown credential type: %s", s.CredentialType)
+	}
 
+	config.AddSecret(c.Token)
+	c.SecretSha256sum = config.Sha256sum(string(doc))
+	c.UsernameSha256sum = config.Sha256sum(c.Username)
+	c.TokenSha256sum = config.Sha256sum(c.Token)
+	log.Debug().Msgf("Username(sha256): %s", c.UsernameSha256sum)
+	log.Debug().Msgf("Token(sha256): %s", c.TokenSha256sum)
+	if !c.Expiry.IsZero() {
+		log.Debug().Msgf("Token expires: %s", c.Expiry.Format(time.RFC3339))
+	}
+	return c, nil
+}
+
+// LoadSecretValue returns the value at key in the secret. ex. a webhook secret
+// The value is registered for redaction
+func LoadSecretValue(s config.Settings, key string, log *zerolog.Logger) (string, error) {
+	doc, err := getSecretDoc(s, log)
+	if err != nil {
+		return "", &Error{Class: ErrorClassCredential, Msg: "unable to read secret", Err: config.RedactError(err)}
+	}
+	var objmap map[string]interface{}
+	if err = json.Unmarshal(doc, &objmap); err != nil {
+		return "", &Error{Class: ErrorClassCredential, Msg: "secret is not a JSON object", Err: err}
+	}
+	value, err := SelectKey(objmap, key)
+	if err != nil {
+		return "", &Error{Class: ErrorClassCredential, Msg: "unable to read secret key", Err: err}
+	}
+	config.AddSecret(value)
+	return value, nil
+}
+
+// getSecretDoc returns the contents of the secret from AWS Secret Manager
+func getSecretDoc(s config.Settings, log *zerolog.Logger) ([]byte, error) {
 	// Set up the client
 	log.Debug().Msg("setting up the AWS Secret Manager client")
-	cfg, err := awscfg.LoadDefaultConfig(context.TODO())
+	cfg, err := LoadAWSConfig(s, log)
 	if err != nil {
-		log.Fatal().Err(err).Msg(err.Error())
+		return nil, err
 	}
 
-	SecretClient := *secretsmanager.NewFromConfig(cfg)
+	var clientOpts []func(*secretsmanager.Options)
+	if s.AWSEndpointURL != "" {
+		log.Debug().Msgf("using AWS Secret Manager endpoint: %s", s.AWSEndpointURL)
+		clientOpts = append(clientOpts,
+			secretsmanager.WithEndpointResolver(secretsmanager.EndpointResolverFromURL(s.AWSEndpointURL)))
+	}
+	SecretClient := *secretsmanager.NewFromConfig(cfg, clientOpts...)
 
 	SecretInput := &secretsmanager.GetSecretValueInput{
 		SecretId:     aws.String(s.SecretID),
 		VersionId:    nil,
 		VersionStage: nil,
 	}
+	// AWSCURRENT is used when neither is set. setting one lets us test a pending rotation
+	if s.SecretVersionID != "" {
+		SecretInput.VersionId = aws.String(s.SecretVersionID)
+	}
+	if s.SecretVersionStage != "" {
+		SecretInput.VersionStage = aws.String(s.SecretVersionStage)
+	}
 	// Get the secret doc from AWS
 
 	log.Debug().Msg("getting the secret doc from AWS SM")
 	secretDoc, err := SecretClient.GetSecretValue(context.TODO(), SecretInput)
 	if err != nil {
-		log.Fatal().Err(err).Msg(err.Error())
+		return nil, err
+	}
+
+	// the secret is either a string or a binary blob. both are parsed the same way
+	if secretDoc.SecretString != nil {
+		return []byte(*secretDoc.SecretString), nil
 	}
+	log.Debug().Msg("secret has no SecretString. using SecretBinary")
+	return secretDoc.SecretBinary, nil
+}
 
-	// unmarshal the JSON secret doc into a map. If the structure isn't a map this will fail
-	log.Debug().Msg("unmarshalling credentials from AWSSM secret doc")
-	var objmap map[string]string
-	err = json.Unmarshal([]byte(*secretDoc.SecretString), &objmap)
+// Refresh replaces an expiring token with a new one
+// Credentials without an expiry are never refreshed
+// Call this before each git command that talks to the remote
+func (c *Credential) Refresh(log *zerolog.Logger) error {
+	if c.Expiry.IsZero() || time.Until(c.Expiry) > credentialRefreshWindow {
+		return nil
+	}
+	if c.refresh == nil {
+		return fmt.Errorf("credential expired at %s and can't be refreshed", c.Expiry.Format(time.RFC3339))
+	}
+	log.Info().Msgf("credential expires at %s. refreshing", c.Expiry.Format(time.RFC3339))
+	fresh, err := c.refresh()
 	if err != nil {
-		log.Fatal().Err(err).Msg(err.Error())
+		return err
+	}
+	config.AddSecret(fresh.Token)
+	secretSum := c.SecretSha256sum
+	*c = *fresh
+	if c.SecretSha256sum == "" {
+		c.SecretSha256sum = secretSum
+	}
+	c.UsernameSha256sum = config.Sha256sum(c.Username)
+	c.TokenSha256sum = config.Sha256sum(c.Token)
+	log.Debug().Msgf("Token(sha256): %s", c.TokenSha256sum)
+	return nil
+}
+
+// GitEnv returns the environment variables git needs to use the credential
+// The token is sent in a header instead of the remote URL: Bearer for bearer tokens,
+// Basic for the rest. The header is git config from the environment, so the token
+// isn't in the process arguments or the mirror config. Config entries already in
+// the environment are kept. An empty credential returns nil
+func (c Credential) GitEnv() []string {
+	if c.Username == "" && c.Token == "" {
+		return nil
+	}
+	header := "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Token))
+	if c.Type == BearerCredential {
+		header = "Authorization: Bearer " + c.Token
+	}
+	n, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	return []string{
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", n+1),
+		fmt.Sprintf("GIT_CONFIG_KEY_%d=http.extraHeader", n),
+		fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", n, header),
+	}
+}
+
+// parseBearer returns a bearer credential from a secret document
+// The expiry is read from ExpiryKey (RFC3339) when it's set
+func parseBearer(doc []byte, s config.Settings) (*Credential, error) {
+	// the username isn't used. setting it skips the UserKey lookup
+	_, token, err := ParseSecret(doc, config.Settings{TokenKey: s.TokenKey, SecretUsername: DefaultSecretUsername})
+	if err != nil {
+		return nil, err
+	}
+	c := &Credential{Type: BearerCredential, Token: token}
+	if s.ExpiryKey == "" {
+		return c, nil
+	}
+	var objmap map[string]interface{}
+	if err := json.Unmarshal(doc, &objmap); err != nil {
+		return nil, fmt.Errorf("expiry key needs a JSON secret: %w", err)
+	}
+	expiry, err := SelectKey(objmap, s.ExpiryKey)
+	if err != nil {
+		return nil, fmt.Errorf("expiry key: %w", err)
+	}
+	if c.Expiry, err = time.Parse(time.RFC3339, expiry); err != nil {
+		return nil, fmt.Errorf("expiry key: %w", err)
+	}
+	return c, nil
+}
+
+// ParseSecret returns the username and token from a secret document
+// A JSON object document is searched with the UserKey and TokenKey selectors.
+// A JSON string is the token. Other JSON, like an array or a number, is an error.
+// Anything that isn't JSON is a plaintext token. The username of a token comes
+// from SecretUsername, or DefaultSecretUsername if that is empty
+func ParseSecret(doc []byte, s config.Settings) (username, token string, err error) {
+	var value interface{}
+	if json.Unmarshal(doc, &value) != nil {
+		value = strings.TrimSpace(string(doc))
 	}
-	// Use the provided username and token key names to get the credential values
-	doc := *secretDoc.SecretString
-	username := objmap[s.UserKey]
-	token := objmap[s.TokenKey]
-
-	log.Debug().Msgf("SecretJSON Document(sha256): %s", config.Sha256sum(doc))
-	log.Debug().Msgf("Username(sha256): %s", config.Sha256sum(username))
-	log.Debug().Msgf("Token(sha256): %s", config.Sha256sum(token))
-
-	return &Credential{
-		SecretSha256sum:   config.Sha256sum(doc),
-		Username:          username,
-		UsernameSha256sum: config.Sha256sum(username),
-		Token:             token,
-		TokenSha256sum:    config.Sha256sum(token),
+	objmap, isObject := value.(map[string]interface{})
+	if !isObject {
+		var isString bool
+		if token, isString = value.(string); !isString {
+			return "", "", fmt.Errorf("secret document is JSON, but not an object or a string")
+		}
+		if token == "" {
+			return "", "", fmt.Errorf("secret document is empty")
+		}
+		username = s.SecretUsername
+		if username == "" {
+			username = DefaultSecretUsername
+		}
+		return username, token, nil
+	}
+
+	if s.SecretUsername != "" {
+		username = s.SecretUsername
+	} else {
+		username, err = SelectKey(objmap, s.UserKey)
+		if err != nil {
+			return "", "", fmt.Errorf("username key: %w", err)
+		}
+	}
+	token, err = SelectKey(objmap, s.TokenKey)
+	if err != nil {
+		return "", "", fmt.Errorf("token key: %w", err)
+	}
+	return username, token, nil
+}
+
+// SelectKey returns the value at selector in a JSON object
+// The selector is a top level key, or a dotted path with optional array indexes
+// and an optional leading "$." (ex. git.users[0].name or $.git.token)
+// Numbers and booleans are returned as strings
+func SelectKey(doc map[string]interface{}, selector string) (string, error) {
+	// a top level key that happens to contain dots wins over the path lookup
+	if v, ok := doc[selector]; ok {
+		return selectedString(v, selector)
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(selector, "$"), ".")
+	if path == "" {
+		return "", fmt.Errorf("empty selector")
+	}
+	var current interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		name := part
+		var indexes []int
+		if i := strings.Index(part, "["); i >= 0 {
+			name = part[:i]
+			for _, idx := range strings.Split(strings.TrimSuffix(part[i+1:], "]"), "][") {
+				n, err := strconv.Atoi(idx)
+				if err != nil {
+					return "", fmt.Errorf("invalid index in selector %s: %s", selector, part)
+				}
+				indexes = append(indexes, n)
+			}
+		}
+		if name != "" {
+			obj, ok := current.(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("selector %s: %s is not an object", selector, name)
+			}
+			if current, ok = obj[name]; !ok {
+				return "", fmt.Errorf("selector %s: key %s not found", selector, name)
+			}
+		}
+		for _, n := range indexes {
+			list, ok := current.([]interface{})
+			if !ok || n < 0 || n >= len(list) {
+				return "", fmt.Errorf("selector %s: index %d out of range", selector, n)
+			}
+			current = list[n]
+		}
+	}
+	return selectedString(current, selector)
+}
+
+// selectedString converts a selected JSON value to a string
+func selectedString(v interface{}, selector string) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case nil:
+		return "", fmt.Errorf("selector %s: value is null", selector)
+	default:
+		return "", fmt.Errorf("selector %s: value is not a string, number or boolean", selector)
 	}
 }
@@ -0,0 +1,133 @@
+package types
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/natemarks/cache_clone/config"
+)
+
+// TestParseSecret covers the secret document shapes we support
+func TestParseSecret(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		settings config.Settings
+		username string
+		token    string
+		wantErr  bool
+	}{
+		{
+			name:     "flat map",
+			doc:      `{"user": "bob", "token": "abc"}`,
+			settings: config.Settings{UserKey: "user", TokenKey: "token"},
+			username: "bob",
+			token:    "abc",
+		},
+		{
+			name:     "nested with index",
+			doc:      `{"git": {"users": [{"name": "bob"}], "token": "abc"}}`,
+			settings: config.Settings{UserKey: "git.users[0].name", TokenKey: "$.git.token"},
+			username: "bob",
+			token:    "abc",
+		},
+		{
+			name:     "dotted top level key",
+			doc:      `{"git.user": "bob", "token": 12345}`,
+			settings: config.Settings{UserKey: "git.user", TokenKey: "token"},
+			username: "bob",
+			token:    "12345",
+		},
+		{
+			name:     "plaintext token",
+			doc:      "abc\n",
+			settings: config.Settings{},
+			username: DefaultSecretUsername,
+			token:    "abc",
+		},
+		{
+			name:     "JSON string token",
+			doc:      `"abc"`,
+			settings: config.Settings{UserKey: "user", TokenKey: "token"},
+			username: DefaultSecretUsername,
+			token:    "abc",
+		},
+		{
+			name:     "empty JSON string",
+			doc:      `""`,
+			settings: config.Settings{UserKey: "user", TokenKey: "token"},
+			wantErr:  true,
+		},
+		{
+			name:     "JSON array",
+			doc:      `["bob", "abc"]`,
+			settings: config.Settings{UserKey: "user", TokenKey: "token"},
+			wantErr:  true,
+		},
+		{
+			name:     "JSON number",
+			doc:      `12345`,
+			settings: config.Settings{UserKey: "user", TokenKey: "token"},
+			wantErr:  true,
+		},
+		{
+			name:     "JSON null",
+			doc:      `null`,
+			settings: config.Settings{UserKey: "user", TokenKey: "token"},
+			wantErr:  true,
+		},
+		{
+			name:     "fixed username",
+			doc:      `{"token": "abc"}`,
+			settings: config.Settings{SecretUsername: "bob", TokenKey: "token"},
+			username: "bob",
+			token:    "abc",
+		},
+		{
+			name:     "missing key",
+			doc:      `{"user": "bob"}`,
+			settings: config.Settings{UserKey: "user", TokenKey: "token"},
+			wantErr:  true,
+		},
+		{
+			name:     "object value",
+			doc:      `{"user": "bob", "token": {"value": "abc"}}`,
+			settings: config.Settings{UserKey: "user", TokenKey: "token"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, token, err := ParseSecret([]byte(tt.doc), tt.settings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSecret() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if username != tt.username || token != tt.token {
+				t.Errorf("ParseSecret() = %s, %s, want %s, %s", username, token, tt.username, tt.token)
+			}
+		})
+	}
+}
+
+// TestGitEnv checks the credential header reaches git without being in its arguments
+func TestGitEnv(t *testing.T) {
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "test.kept")
+	t.Setenv("GIT_CONFIG_VALUE_0", "yes")
+	c := Credential{Type: BearerCredential, Token: "tok-in-env"}
+	result, err := runGit(context.Background(), c, "config", "--get", "http.extraHeader")
+	if err != nil || strings.TrimSpace(result.StdOut) != "Authorization: Bearer tok-in-env" {
+		t.Errorf("http.extraHeader = %q, %v", result.StdOut, err)
+	}
+	if result, _ = runGit(context.Background(), c, "config", "--get", "test.kept"); strings.TrimSpace(result.StdOut) != "yes" {
+		t.Errorf("config from the environment was dropped: %q", result.StdOut)
+	}
+	basic := Credential{Type: BasicCredential, Username: "bob", Token: "tok"}
+	if result, _ = runGit(context.Background(), basic, "config", "--get", "http.extraHeader"); strings.TrimSpace(result.StdOut) != "Authorization: Basic Ym9iOnRvaw==" {
+		t.Errorf("basic http.extraHeader = %q", result.StdOut)
+	}
+	if env := (Credential{}).GitEnv(); env != nil {
+		t.Errorf("empty credential env = %v", env)
+	}
+}
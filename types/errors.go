@@ -0,0 +1,168 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/natemarks/cache_clone/config"
+)
+
+// Error classes. They are reported in the run report so a pipeline can tell
+// infrastructure problems (network, auth) from problems with the repo
+const (
+	ErrorClassCredential  = "credential"
+	ErrorClassAuth        = "auth"
+	ErrorClassNetwork     = "network"
+	ErrorClassFilesystem  = "filesystem"
+	ErrorClassDirty       = "dirty_repo"
+	ErrorClassLocalExists = "local_exists"
+	ErrorClassUnsafePush  = "unsafe_push"
+	// the server refused a pushed ref
+	ErrorClassNonFastForward = "non_fast_forward"
+	ErrorClassHookRejected   = "hook_rejected"
+	ErrorClassPermission     = "permission_denied"
+	ErrorClassGit            = "git"
+	ErrorClassUnknown        = "unknown"
+)
+
+// exitCodes is the process exit code for each error class
+// 1 is left for failures without a class (and cobra usage errors)
+var exitCodes = map[string]int{
+	ErrorClassCredential:     3,
+	ErrorClassAuth:           4,
+	ErrorClassNetwork:        5,
+	ErrorClassFilesystem:     6,
+	ErrorClassDirty:          7,
+	ErrorClassLocalExists:    8,
+	ErrorClassUnsafePush:     9,
+	ErrorClassNonFastForward: 10,
+	ErrorClassHookRejected:   11,
+	ErrorClassPermission:     12,
+	ErrorClassGit:            13,
+}
+
+// Error is a failed operation with a class for reporting
+type Error struct {
+	Class string
+	Msg   string
+	Err   error
+	// "remote:" lines from the server. ex. pre-receive hook output
+	RemoteMessages []string
+}
+
+// Error returns the message and the underlying error
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s: %s", e.Msg, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorClass returns the class of err. empty if err is nil
+func ErrorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Class
+	}
+	return ErrorClassUnknown
+}
+
+// IsUnreachable returns true if err means the remote can't be reached
+// A credential that can't be loaded or refreshed because AWS or the git server API
+// can't be reached counts too
+func IsUnreachable(err error) bool {
+	switch ErrorClass(err) {
+	case ErrorClassNetwork:
+		return true
+	case ErrorClassCredential:
+	default:
+		return false
+	}
+	for ; err != nil; err = errors.Unwrap(err) {
+		var netErr net.Error
+		if e, ok := err.(*Error); ok && e.Class == ErrorClassNetwork || errors.As(err, &netErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExitCode returns the process exit code for err. 0 if err is nil
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if code, ok := exitCodes[ErrorClass(err)]; ok {
+		return code
+	}
+	return 1
+}
+
+// RemoteMessages returns the "remote:" lines carried by err, if any
+func RemoteMessages(err error) []string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.RemoteMessages
+	}
+	return nil
+}
+
+// remoteMessages returns the "remote:" lines of git output without the prefix
+// and the padding git adds to overwrite progress output
+func remoteMessages(stderr string) []string {
+	var messages []string
+	for _, line := range strings.Split(stderr, "\n") {
+		line = strings.TrimRight(line, " \r")
+		if !strings.HasPrefix(line, "remote:") {
+			continue
+		}
+		if line = strings.TrimSpace(strings.TrimPrefix(line, "remote:")); line != "" {
+			messages = append(messages, config.Redact(line))
+		}
+	}
+	return messages
+}
+
+// gitError returns an error for a failed git command
+// The class is guessed from the git output
+func gitError(msg string, result config.Result, err error) error {
+	return &Error{Class: classifyGitOutput(result.StdErr), Msg: msg, Err: commandError(result, err)}
+}
+
+// commandError returns the error of a failed command with its redacted stderr
+func commandError(result config.Result, err error) error {
+	if err == nil {
+		err = fmt.Errorf("exit code %d", result.ReturnCode)
+	}
+	stderr := strings.TrimSpace(config.Redact(result.StdErr))
+	if stderr != "" {
+		err = fmt.Errorf("%w: %s", err, stderr)
+	}
+	return err
+}
+
+// classifyGitOutput returns the error class for git stderr output
+func classifyGitOutput(stderr string) string {
+	out := strings.ToLower(stderr)
+	for _, s := range []string{"authentication failed", "could not read username", "returned error: 401", "returned error: 403"} {
+		if strings.Contains(out, s) {
+			return ErrorClassAuth
+		}
+	}
+	for _, s := range []string{"could not resolve host", "failed to connect", "connection refused", "connection timed out", "operation timed out", "network is unreachable", "ssl", "returned error: 5"} {
+		if strings.Contains(out, s) {
+			return ErrorClassNetwork
+		}
+	}
+	return ErrorClassGit
+}
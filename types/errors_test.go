@@ -0,0 +1,53 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	hook := &Error{Class: ErrorClassHookRejected, Msg: "remote rejected refs/heads/a (hook)"}
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{errors.New("no class"), 1},
+		{hook, 11},
+		{fmt.Errorf("wrapped: %w", hook), 11},
+		{&Error{Class: ErrorClassNonFastForward}, 10},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("ExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteMessages(t *testing.T) {
+	stderr := "remote: \nremote: rejecting refs/heads/a        \nremote: see https://ci/jobs/1\r\nTo http://git/org/repo.git\n ! [remote rejected] a -> a (pre-receive hook declined)\n"
+	want := []string{"rejecting refs/heads/a", "see https://ci/jobs/1"}
+	if got := remoteMessages(stderr); !reflect.DeepEqual(got, want) {
+		t.Errorf("remoteMessages() = %q, want %q", got, want)
+	}
+}
+
+func TestIsUnreachable(t *testing.T) {
+	dial := &url.Error{Op: "Post", URL: "https://api.github.com", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	for err, want := range map[error]bool{
+		&Error{Class: ErrorClassNetwork, Msg: "fetch"}:                                                         true,
+		&Error{Class: ErrorClassCredential, Msg: "load", Err: dial}:                                            true,
+		&Error{Class: ErrorClassCredential, Msg: "refresh", Err: &Error{Class: ErrorClassNetwork, Msg: "503"}}: true,
+		&Error{Class: ErrorClassCredential, Msg: "load", Err: errors.New("no secret")}:                         false,
+		&Error{Class: ErrorClassAuth, Msg: "fetch", Err: dial}:                                                 false,
+		errors.New("other"): false,
+	} {
+		if got := IsUnreachable(err); got != want {
+			t.Errorf("IsUnreachable(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
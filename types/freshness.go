@@ -0,0 +1,155 @@
+package types
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stamp files kept in the bare mirror directory. git ignores them
+const (
+	// one unix time per line for each clone, update or served request
+	accessFile = "cache_clone.access"
+	// modified after each successful clone or fetch from the remote
+	fetchedFile = "cache_clone.fetched"
+)
+
+// accessWindow is how long accesses are kept for the access frequency
+const accessWindow = 24 * time.Hour
+
+// LastFetched returns when the mirror was last cloned or fetched from the remote
+// Mirrors created before the stamp file existed use FETCH_HEAD. Without either it is
+// unknown and an error. The mirror directory changes with every stamp, so it can't tell
+func (m *Mirror) LastFetched() (time.Time, error) {
+	var err error
+	for _, name := range []string{fetchedFile, "FETCH_HEAD"} {
+		var info os.FileInfo
+		if info, err = os.Stat(filepath.Join(m.Path, name)); err == nil {
+			return info.ModTime(), nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// IsFreshFor returns true if the mirror was fetched less than maxAge ago
+func (m *Mirror) IsFreshFor(maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+	fetched, err := m.LastFetched()
+	return err == nil && time.Since(fetched) < maxAge
+}
+
+// markFetched records a successful clone or fetch
+func (m *Mirror) markFetched() error {
+	return m.touchStamp(fetchedFile)
+}
+
+// touchStamp sets the modification time of a stamp file to now
+func (m *Mirror) touchStamp(name string) error {
+	p := filepath.Join(m.Path, name)
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err == nil {
+		return nil
+	}
+	return m.writeStamp(p, nil)
+}
+
+// RecordAccess records that the mirror was used
+func (m *Mirror) RecordAccess() error {
+	return m.writeStamp(filepath.Join(m.Path, accessFile), []byte(strconv.FormatInt(time.Now().Unix(), 10)+"\n"))
+}
+
+// writeStamp appends data to a stamp file with the mirror file mode
+// Short appends are atomic, so concurrent runs don't need a lock
+func (m *Mirror) writeStamp(p string, data []byte) error {
+	mode := m.Perms.FileMode
+	if mode == 0 {
+		mode = 0644
+	}
+	_, statErr := os.Stat(p)
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if os.IsNotExist(statErr) {
+		// the umask applies on create
+		if err = f.Chmod(mode); err != nil {
+			return err
+		}
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// Accesses returns the number of recorded accesses since a time
+func (m *Mirror) Accesses(since time.Time) (int, error) {
+	f, err := os.Open(filepath.Join(m.Path, accessFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		t, err := strconv.ParseInt(strings.TrimSpace(scanner.Text()), 10, 64)
+		if err == nil && t >= since.Unix() {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+// AccessRate returns the accesses per hour over the last day
+// The access file is trimmed to that window
+func (m *Mirror) AccessRate() (float64, error) {
+	since := time.Now().Add(-accessWindow)
+	count, err := m.Accesses(since)
+	if err != nil {
+		return 0, err
+	}
+	if err = m.trimAccesses(since); err != nil {
+		return 0, fmt.Errorf("unable to trim %s: %w", accessFile, err)
+	}
+	return float64(count) / accessWindow.Hours(), nil
+}
+
+// trimAccesses drops accesses older than since
+// An access recorded while the file is rewritten may be lost. It's only a frequency
+func (m *Mirror) trimAccesses(since time.Time) error {
+	p := filepath.Join(m.Path, accessFile)
+	data, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if t, err := strconv.ParseInt(line, 10, 64); err == nil && t >= since.Unix() {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == len(strings.Split(strings.TrimSpace(string(data)), "\n")) {
+		return nil
+	}
+	tmp := p + ".tmp"
+	os.Remove(tmp)
+	content := strings.Join(kept, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	if err = m.writeStamp(tmp, []byte(content)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
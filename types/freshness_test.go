@@ -0,0 +1,65 @@
+package types
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAccessRate(t *testing.T) {
+	m := &Mirror{Path: t.TempDir()}
+	old := strconv.FormatInt(time.Now().Add(-48*time.Hour).Unix(), 10) + "\n"
+	if err := os.WriteFile(filepath.Join(m.Path, accessFile), []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 48; i++ {
+		if err := m.RecordAccess(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rate, err := m.AccessRate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 2 {
+		t.Errorf("AccessRate() = %v, want 2", rate)
+	}
+	// the old access is trimmed
+	if n, _ := m.Accesses(time.Time{}); n != 48 {
+		t.Errorf("Accesses() = %d after trim, want 48", n)
+	}
+}
+
+func TestIsFreshFor(t *testing.T) {
+	m := &Mirror{Path: t.TempDir()}
+	if err := m.markFetched(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.IsFreshFor(time.Minute) {
+		t.Error("mirror fetched now is not fresh for 1m")
+	}
+	if m.IsFreshFor(0) {
+		t.Error("max age 0 must always fetch")
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(m.Path, fetchedFile), past, past); err != nil {
+		t.Fatal(err)
+	}
+	if m.IsFreshFor(time.Minute) {
+		t.Error("mirror fetched an hour ago is fresh for 1m")
+	}
+
+	// a mirror that was never stamped, used just now
+	legacy := &Mirror{Path: t.TempDir()}
+	if err := legacy.RecordAccess(); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.IsFreshFor(time.Hour) {
+		t.Error("mirror without a fetch time is fresh")
+	}
+	if _, err := legacy.LastFetched(); err == nil {
+		t.Error("LastFetched() of a mirror without a fetch time succeeded")
+	}
+}
@@ -0,0 +1,155 @@
+package types
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/rs/zerolog"
+)
+
+// DefaultGitHubAPIURL is the API base URL for github.com
+// GitHub Enterprise Server uses https://<host>/api/v3
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// GitHubApp is a GitHub App installation that can mint installation tokens
+type GitHubApp struct {
+	AppID          string
+	InstallationID string
+	PrivateKey     *rsa.PrivateKey
+	// API base URL. ex. https://api.github.com
+	APIURL string
+}
+
+// ParseGitHubApp returns the GitHub App from a secret document
+// The app id, installation id and PEM private key are read with the AppIDKey,
+// InstallationIDKey and PrivateKeyKey selectors
+func ParseGitHubApp(doc []byte, s config.Settings) (*GitHubApp, error) {
+	var objmap map[string]interface{}
+	if err := json.Unmarshal(doc, &objmap); err != nil {
+		return nil, fmt.Errorf("GitHub App secret must be a JSON object: %w", err)
+	}
+	appID, err := SelectKey(objmap, s.AppIDKey)
+	if err != nil {
+		return nil, fmt.Errorf("app id key: %w", err)
+	}
+	installationID, err := SelectKey(objmap, s.InstallationIDKey)
+	if err != nil {
+		return nil, fmt.Errorf("installation id key: %w", err)
+	}
+	pemKey, err := SelectKey(objmap, s.PrivateKeyKey)
+	if err != nil {
+		return nil, fmt.Errorf("private key key: %w", err)
+	}
+	config.AddSecret(pemKey)
+	key, err := parseRSAPrivateKey([]byte(pemKey))
+	if err != nil {
+		return nil, err
+	}
+	apiURL := s.GitHubAPIURL
+	if apiURL == "" {
+		apiURL = DefaultGitHubAPIURL
+	}
+	return &GitHubApp{
+		AppID:          appID,
+		InstallationID: installationID,
+		PrivateKey:     key,
+		APIURL:         strings.TrimSuffix(apiURL, "/"),
+	}, nil
+}
+
+// parseRSAPrivateKey parses a PKCS1 or PKCS8 PEM encoded RSA key
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// JWT returns an app JWT signed with the private key
+// GitHub allows at most 10 minutes. iat is backdated to allow for clock drift
+func (a GitHubApp) JWT(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-60 * time.Second).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.AppID,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.PrivateKey, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// InstallationToken exchanges an app JWT for an installation token
+// The returned credential refreshes itself with the same app
+func (a GitHubApp) InstallationToken(log *zerolog.Logger) (*Credential, error) {
+	jwt, err := a.JWT(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	config.AddSecret(jwt)
+	tokenURL := fmt.Sprintf("%s/app/installations/%s/access_tokens", a.APIURL, a.InstallationID)
+	log.Debug().Msgf("requesting installation token: %s", tokenURL)
+	req, err := http.NewRequest(http.MethodPost, tokenURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		// the API is down, like the git server behind it
+		return nil, &Error{Class: ErrorClassNetwork, Msg: "installation token request failed: " + resp.Status}
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("installation token request failed: %s", resp.Status)
+	}
+	var body struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("unable to decode installation token: %w", err)
+	}
+	config.AddSecret(body.Token)
+	return &Credential{
+		Type:     GitHubAppCredential,
+		Username: DefaultSecretUsername,
+		Token:    body.Token,
+		Expiry:   body.ExpiresAt,
+		refresh:  func() (*Credential, error) { return a.InstallationToken(log) },
+	}, nil
+}
@@ -0,0 +1,86 @@
+package types
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/natemarks/cache_clone/config"
+)
+
+// TestGitHubAppInstallationToken mints a token against a fake GitHub API
+// and checks that an expiring token is refreshed
+func TestGitHubAppInstallationToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app/installations/42/access_tokens" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		// verify the JWT signature with the public key
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+			t.Errorf("invalid JWT signature: %v", err)
+		}
+		calls++
+		// the first token is about to expire so the refresh is exercised
+		expires := time.Now().Add(time.Minute)
+		if calls > 1 {
+			expires = time.Now().Add(time.Hour)
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": "token%d", "expires_at": "%s"}`, calls, expires.Format(time.RFC3339))
+	}))
+	defer server.Close()
+
+	doc, _ := json.Marshal(map[string]interface{}{"app_id": 7, "installation_id": 42, "private_key": string(keyPEM)})
+	s := config.Settings{
+		AppIDKey:          "app_id",
+		InstallationIDKey: "installation_id",
+		PrivateKeyKey:     "private_key",
+		GitHubAPIURL:      server.URL,
+	}
+	log := config.GetLogger(s)
+
+	app, err := ParseGitHubApp(doc, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redacted := config.Redact(string(doc)); strings.Contains(redacted, "PRIVATE KEY-----\\n") {
+		t.Errorf("private key isn't redacted: %s", redacted)
+	}
+	c, err := app.InstallationToken(&log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Token != "token1" || c.Username != DefaultSecretUsername {
+		t.Fatalf("unexpected credential: %s %s", c.Username, c.Token)
+	}
+	if err := c.Refresh(&log); err != nil {
+		t.Fatal(err)
+	}
+	if c.Token != "token2" {
+		t.Fatalf("expiring token was not refreshed: %s", c.Token)
+	}
+	if err := c.Refresh(&log); err != nil || c.Token != "token2" {
+		t.Fatalf("fresh token should not be refreshed: %s %v", c.Token, err)
+	}
+}
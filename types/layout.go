@@ -0,0 +1,132 @@
+package types
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/rs/zerolog"
+)
+
+// Mirror root layouts
+const (
+	// <root>/<host>/<path>
+	LayoutPath = "path"
+	// <root>/<sha256 of host and path>.git, named in the index file
+	LayoutHashed = "hashed"
+)
+
+// indexFile maps hashed mirror names to remote URLs. one "<name> <url>" per line
+const indexFile = "cache_clone.index"
+
+// hashedPattern matches a mirror directory name in the hashed layout
+var hashedPattern = regexp.MustCompile(`^[0-9a-f]{64}\.git$`)
+
+// HashedName returns the mirror directory name of a normalized remote in the hashed layout
+// The scheme isn't part of it, like the path layout
+func HashedName(r HTTPSRemote) string {
+	sum := sha256.Sum256([]byte(r.Host + r.Path))
+	return hex.EncodeToString(sum[:]) + ".git"
+}
+
+// IsHashed returns true if the mirror at p is in the hashed layout of root
+func IsHashed(root, p string) bool {
+	return filepath.Dir(p) == filepath.Clean(root) && hashedPattern.MatchString(filepath.Base(p))
+}
+
+// ReservedHost returns true if the mirror root keeps its own files where the path
+// layout would put the mirrors of host, so no remote on it may be served or fetched
+func ReservedHost(host string) bool {
+	return strings.EqualFold(host, NetworksDir) || strings.EqualFold(host, indexFile)
+}
+
+// ReadIndex returns the remote URL of each hashed mirror name in the mirror root
+func ReadIndex(root string) (map[string]string, error) {
+	index := map[string]string{}
+	f, err := os.Open(filepath.Join(root, indexFile))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 {
+			index[fields[0]] = fields[1]
+		}
+	}
+	return index, scanner.Err()
+}
+
+// recordIndex adds a hashed mirror to the index file of its root
+// Mirrors in the path layout aren't indexed
+func (m *Mirror) recordIndex() error {
+	if m.indexURL == "" {
+		return nil
+	}
+	root := filepath.Dir(m.Path)
+	index, err := ReadIndex(root)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(m.Path)
+	if index[name] == m.indexURL {
+		return nil
+	}
+	return m.writeStamp(filepath.Join(root, indexFile), []byte(name+" "+m.indexURL+"\n"))
+}
+
+// MigrateToHashed moves a path layout mirror into the hashed layout of s.Mirror without
+// cloning it again and returns the new path
+// With link a symlink is left at the old path, so local clones of it keep working.
+// A mirror whose hashed path already exists is left in place and is an error
+func (m *Mirror) MigrateToHashed(ctx context.Context, s config.Settings, link bool, log *zerolog.Logger) (string, error) {
+	root := s.Mirror
+	remote, err := m.Remote(ctx)
+	if err != nil {
+		return "", err
+	}
+	remote = remote.Normalize(s)
+	target := filepath.Join(root, HashedName(*remote))
+	if _, err = os.Lstat(target); err == nil {
+		return "", &Error{Class: ErrorClassFilesystem, Msg: fmt.Sprintf("%s is already migrated to %s. remove one of them", m.Path, target)}
+	}
+	old := m.Path
+	if err = os.Rename(old, target); err != nil {
+		return "", &Error{Class: ErrorClassFilesystem, Msg: "unable to move " + old, Err: err}
+	}
+	m.Path = target
+	m.indexURL = remote.URL.String()
+	if err = m.recordIndex(); err != nil {
+		return target, &Error{Class: ErrorClassFilesystem, Msg: "unable to update the mirror index", Err: err}
+	}
+	if link {
+		if err = os.Symlink(target, old); err != nil {
+			return target, &Error{Class: ErrorClassFilesystem, Msg: "unable to link " + old, Err: err}
+		}
+	} else {
+		removeEmptyParents(filepath.Dir(old), root)
+	}
+	log.Debug().Msgf("moved %s to %s", old, target)
+	return target, nil
+}
+
+// removeEmptyParents removes dir and its parents up to root while they are empty
+func removeEmptyParents(dir, root string) {
+	root = filepath.Clean(root)
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
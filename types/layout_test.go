@@ -0,0 +1,63 @@
+package types
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/rs/zerolog"
+)
+
+func TestMigrateToHashed(t *testing.T) {
+	log := zerolog.Nop()
+	root := t.TempDir()
+	work := t.TempDir()
+	git(t, "-C", work, "init", "-q")
+	git(t, "-C", work, "-c", "user.name=a", "-c", "user.email=a@b", "commit", "-q", "--allow-empty", "-m", "one")
+
+	s := config.Settings{Mirror: root, Remote: "https://Host/org/repo"}
+	old := NewMirror(s, &log).Path
+	git(t, "clone", "-q", "--mirror", work, old)
+	git(t, "-C", old, "remote", "set-url", "origin", "https://host/org/repo.git")
+
+	s.MirrorLayout = LayoutHashed
+	want := NewMirror(s, &log).Path
+	if !IsHashed(root, want) || IsHashed(root, old) {
+		t.Fatalf("hashed mirror path = %s", want)
+	}
+	m := &Mirror{Path: old}
+	got, err := m.MigrateToHashed(context.Background(), config.Settings{Mirror: root}, false, &log)
+	if err != nil || got != want {
+		t.Fatalf("MigrateToHashed() = %s, %v, want %s", got, err, want)
+	}
+	if !isDir(got) || isDir(old) || isDir(filepath.Join(root, "host")) {
+		t.Errorf("mirror wasn't moved and its old parents removed")
+	}
+	index, err := ReadIndex(root)
+	if err != nil || index[filepath.Base(got)] != "https://host/org/repo.git" {
+		t.Errorf("index = %v, %v", index, err)
+	}
+
+	// an equivalent mirror already in the hashed layout is left in place
+	s.MirrorLayout = LayoutPath
+	dup := NewMirror(s, &log).Path
+	git(t, "clone", "-q", "--mirror", work, dup)
+	git(t, "-C", dup, "remote", "set-url", "origin", "https://HOST:443/org/repo")
+	if _, err = (&Mirror{Path: dup}).MigrateToHashed(context.Background(), config.Settings{Mirror: root}, true, &log); err == nil || !isDir(dup) {
+		t.Errorf("MigrateToHashed() replaced an existing hashed mirror")
+	}
+	if err = os.RemoveAll(got); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = (&Mirror{Path: dup}).MigrateToHashed(context.Background(), config.Settings{Mirror: root}, true, &log); err != nil {
+		t.Fatal(err)
+	}
+	if link, _ := os.Readlink(dup); link != got {
+		t.Errorf("old mirror path links to %q, want %s", link, got)
+	}
+	if index, _ = ReadIndex(root); len(index) != 1 {
+		t.Errorf("index = %v", index)
+	}
+}
@@ -0,0 +1,244 @@
+package types
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/tracing"
+	"github.com/rs/zerolog"
+)
+
+// What CloneLocal does when the local directory already exists
+const (
+	// LocalFail refuses to touch an existing directory
+	LocalFail = "fail"
+	// LocalReuse fetches from the mirror and resets the existing checkout
+	LocalReuse = "reuse"
+	// LocalReplace deletes the existing checkout and clones again
+	LocalReplace = "replace"
+)
+
+// CloneLocal clones the mirror to l and checks out ref (the mirror default branch if empty)
+// mode decides what happens when l is an existing, non empty directory. An existing
+// directory is only reused or replaced if it is a checkout of this mirror or remote
+func (m *Mirror) CloneLocal(ctx context.Context, l, mode, ref string, r HTTPSRemote, log *zerolog.Logger) (err error) {
+	exists, err := nonEmptyDir(l)
+	if err != nil {
+		return &Error{Class: ErrorClassFilesystem, Msg: "unable to check local directory " + l, Err: err}
+	}
+	if !exists {
+		return m.freshLocal(ctx, l, ref, log)
+	}
+	if mode == "" || mode == LocalFail {
+		return &Error{Class: ErrorClassLocalExists, Msg: fmt.Sprintf(
+			"local directory %s already exists. use --reuse to update it or --replace to clone it again", l)}
+	}
+	if err = m.checkLocalOrigin(ctx, l, r); err != nil {
+		return err
+	}
+	switch mode {
+	case LocalReuse:
+		log.Info().Msgf("reusing existing local repo: %s", l)
+		return m.ReuseLocal(ctx, l, ref, log)
+	case LocalReplace:
+		log.Info().Msgf("replacing existing local repo: %s", l)
+		if err = os.RemoveAll(l); err != nil {
+			return &Error{Class: ErrorClassFilesystem, Msg: "unable to remove local directory " + l, Err: err}
+		}
+		return m.freshLocal(ctx, l, ref, log)
+	}
+	return fmt.Errorf("unknown local mode: %s", mode)
+}
+
+// freshLocal clones the mirror to l and checks out ref
+// Without ref git already checked out the mirror HEAD, or nothing if it is unborn
+func (m *Mirror) freshLocal(ctx context.Context, l, ref string, log *zerolog.Logger) error {
+	if err := m.MakeLocal(ctx, l, log); err != nil {
+		return err
+	}
+	if ref == "" {
+		return nil
+	}
+	return Checkout(ctx, l, ref, log)
+}
+
+// ReuseLocal fetches the mirror into an existing checkout and resets it to ref
+// Local changes to tracked files are discarded. The mirror is fetched by path, so a
+// checkout whose origin is the remote doesn't fetch from the remote without the credential
+func (m *Mirror) ReuseLocal(ctx context.Context, l, ref string, log *zerolog.Logger) (err error) {
+	ctx, span := tracing.Start(ctx, "local.reuse")
+	span.SetAttribute("local.path", l)
+	defer func() { span.Finish(err) }()
+
+	log.Debug().Msgf("fetching mirror(%s) into local repo(%s)", m.Path, l)
+	result, err := config.Run(ctx, []string{"git", "-C", l, "fetch", "--prune", "--tags", "--", m.Path, "+refs/heads/*:refs/remotes/origin/*"})
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to fetch mirror into "+l, result, err)
+	}
+	return Checkout(ctx, l, ref, log)
+}
+
+// Checkout resets a local repo to ref
+// A branch is checked out and reset to the origin branch. A tag or commit is checked out detached
+// An empty ref resets the current branch to its origin branch. Without a current
+// branch that origin has, ref is required
+func Checkout(ctx context.Context, l, ref string, log *zerolog.Logger) error {
+	// git would read it as an option
+	if strings.HasPrefix(ref, "-") {
+		return &Error{Class: ErrorClassGit, Msg: "invalid ref " + ref}
+	}
+	current := ref == ""
+	if current {
+		result, _ := config.Run(ctx, []string{"git", "-C", l, "branch", "--show-current"})
+		ref = strings.TrimSpace(result.StdOut)
+		if ref == "" {
+			return &Error{Class: ErrorClassGit, Msg: fmt.Sprintf("%s has no current branch (detached HEAD). use --ref to choose a branch, tag or commit", l)}
+		}
+	}
+	var args []string
+	if result, _ := config.Run(ctx, []string{"git", "-C", l, "rev-parse", "--verify", "--quiet", "refs/remotes/origin/" + ref}); result.ReturnCode == 0 {
+		log.Debug().Msgf("checking out branch %s in %s", ref, l)
+		args = []string{"git", "-C", l, "checkout", "--force", "-B", ref, "refs/remotes/origin/" + ref, "--"}
+	} else if current {
+		return &Error{Class: ErrorClassGit, Msg: fmt.Sprintf("current branch %s of %s isn't in the mirror. use --ref to choose a branch, tag or commit", ref, l)}
+	} else {
+		log.Debug().Msgf("checking out %s (detached) in %s", ref, l)
+		// the ref can't be read as a path either
+		args = []string{"git", "-C", l, "checkout", "--force", "--detach", ref, "--"}
+	}
+	result, err := config.Run(ctx, args)
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to check out "+ref, result, err)
+	}
+	return nil
+}
+
+// checkLocalOrigin returns an error unless l is a git checkout whose origin is
+// this mirror or the remote
+func (m *Mirror) checkLocalOrigin(ctx context.Context, l string, r HTTPSRemote) error {
+	result, err := config.Run(ctx, []string{"git", "-C", l, "remote", "get-url", "origin"})
+	if err != nil || result.ReturnCode != 0 {
+		return &Error{Class: ErrorClassLocalExists, Msg: fmt.Sprintf(
+			"local directory %s exists and is not a git checkout with an origin remote. remove it or use a different --local", l)}
+	}
+	origin := strings.TrimSpace(result.StdOut)
+	if filepath.Clean(origin) == filepath.Clean(m.Path) || sameRemote(origin, r) {
+		return nil
+	}
+	return &Error{Class: ErrorClassLocalExists, Msg: fmt.Sprintf(
+		"local directory %s is a checkout of %s, not %s. remove it or use a different --local", l, config.Redact(origin), config.Redact(r.URL.String()))}
+}
+
+// sameRemote compares the normalized forms of a URL and the remote
+func sameRemote(u string, r HTTPSRemote) bool {
+	other, err := NewRemote(u)
+	if err != nil {
+		return false
+	}
+	a, b := other.Normalize(config.Settings{}), r.Normalize(config.Settings{})
+	return a.Host == b.Host && a.Path == b.Path
+}
+
+// nonEmptyDir returns true if dir exists and has any entries
+// git clone works into an empty directory, so that isn't treated as existing
+func nonEmptyDir(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(entries) > 0, nil
+}
+
+// checkClean returns an error if the local repo has uncommitted changes
+func checkClean(ctx context.Context, l string, log *zerolog.Logger) error {
+	log.Debug().Msgf("Checking status of local repo: %s", l)
+	result, err := config.Run(ctx, []string{"git", "-C", l, "status", "--short"})
+	if err != nil || result.ReturnCode != 0 || result.StdOut != "" {
+		if err == nil && result.ReturnCode == 0 {
+			err = fmt.Errorf("uncommitted changes:\n%s", strings.TrimRight(result.StdOut, "\n"))
+		} else {
+			err = commandError(result, err)
+		}
+		return &Error{Class: ErrorClassDirty, Msg: "local repo is dirty " + l, Err: err}
+	}
+	return nil
+}
+
+// LocalMirror returns the mirror a local checkout was cloned from and the mirror remote
+// The remote has no userinfo. Use it with a fresh credential
+func LocalMirror(ctx context.Context, l string, s config.Settings) (*Mirror, *HTTPSRemote, error) {
+	result, err := config.Run(ctx, []string{"git", "-C", l, "remote", "get-url", "origin"})
+	if err != nil || result.ReturnCode != 0 {
+		return nil, nil, gitError("unable to get the origin of "+l, result, err)
+	}
+	m := &Mirror{Path: strings.TrimSpace(result.StdOut)}
+	if m.Perms, err = config.ParsePermissions(s); err != nil {
+		return nil, nil, &Error{Class: ErrorClassFilesystem, Msg: "invalid mirror permissions", Err: err}
+	}
+	result, err = config.Run(ctx, []string{"git", "-C", m.Path, "rev-parse", "--is-bare-repository"})
+	if err != nil || result.ReturnCode != 0 || result.StdOut != "true\n" {
+		return nil, nil, &Error{Class: ErrorClassLocalExists, Msg: fmt.Sprintf(
+			"the origin of %s is %s, which is not a cache_clone mirror", l, config.Redact(m.Path))}
+	}
+	m.IsCloned = true
+	r, err := m.Remote(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, r, nil
+}
+
+// Remote returns the remote of the mirror without the credential in its URL
+func (m *Mirror) Remote(ctx context.Context) (*HTTPSRemote, error) {
+	result, err := config.Run(ctx, []string{"git", "-C", m.Path, "remote", "get-url", "origin"})
+	if err != nil || result.ReturnCode != 0 {
+		return nil, gitError("unable to get the remote of mirror "+m.Path, result, err)
+	}
+	r, err := NewRemote(strings.TrimSpace(result.StdOut))
+	if err != nil {
+		return nil, &Error{Class: ErrorClassGit, Msg: "invalid mirror remote", Err: err}
+	}
+	r.URL.User = nil
+	return r, nil
+}
+
+// UpdateLocal fetches the mirror into a clean local checkout and brings the
+// current branch up to date with its origin branch
+// It fast-forwards, or resets to the origin branch if hardReset is set
+func (m *Mirror) UpdateLocal(ctx context.Context, l string, hardReset bool, log *zerolog.Logger) (err error) {
+	ctx, span := tracing.Start(ctx, "local.update")
+	span.SetAttribute("local.path", l)
+	defer func() { span.Finish(err) }()
+
+	if err = checkClean(ctx, l, log); err != nil {
+		return err
+	}
+	result, _ := config.Run(ctx, []string{"git", "-C", l, "branch", "--show-current"})
+	branch := strings.TrimSpace(result.StdOut)
+	if branch == "" {
+		return &Error{Class: ErrorClassGit, Msg: "local repo " + l + " has a detached HEAD. check out a branch to update it"}
+	}
+	log.Debug().Msgf("fetching mirror(%s) into local repo(%s)", m.Path, l)
+	result, err = config.Run(ctx, []string{"git", "-C", l, "fetch", "--prune", "--tags", "origin"})
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to fetch mirror into "+l, result, err)
+	}
+	target := "refs/remotes/origin/" + branch
+	args := []string{"git", "-C", l, "merge", "--ff-only", target}
+	if hardReset {
+		args = []string{"git", "-C", l, "reset", "--hard", target}
+	}
+	log.Info().Msgf("updating %s branch %s from %s", l, branch, target)
+	result, err = config.Run(ctx, args)
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to update "+branch+" in "+l+". use --hard-reset to discard local commits", result, err)
+	}
+	return nil
+}
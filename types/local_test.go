@@ -0,0 +1,133 @@
+package types
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestCheckout(t *testing.T) {
+	log := zerolog.Nop()
+	s, m, _ := pushFixture(t, false)
+	git(t, "-C", m.Path, "tag", "v1", "main")
+	git(t, "-C", s.Local, "fetch", "-q", "--tags", "origin")
+	commitFile(t, s.Local, "v1", "a file named like the tag\n")
+
+	// an empty ref resets the current branch to the mirror, dropping the local commit
+	if err := Checkout(context.Background(), s.Local, "", &log); err != nil {
+		t.Fatal(err)
+	}
+	if head, want := git(t, "-C", s.Local, "rev-parse", "HEAD"), refsOf(t, m.Path)["refs/heads/main"]; head != want {
+		t.Errorf("HEAD = %s, want %s", head, want)
+	}
+	if err := Checkout(context.Background(), s.Local, "v1", &log); err != nil {
+		t.Fatal(err)
+	}
+	if branch := git(t, "-C", s.Local, "branch", "--show-current"); branch != "" {
+		t.Errorf("tag checkout is on branch %s", branch)
+	}
+	for _, ref := range []string{"", "--help", "missing"} {
+		if err := Checkout(context.Background(), s.Local, ref, &log); err == nil {
+			t.Errorf("Checkout(context.Background(), %q) on a detached HEAD succeeded", ref)
+		} else if ref == "" && !strings.Contains(err.Error(), "--ref") {
+			t.Errorf("Checkout(context.Background()) error doesn't say to use --ref: %v", err)
+		}
+	}
+
+	// a current branch the mirror doesn't have
+	git(t, "-C", s.Local, "checkout", "-q", "-b", "topic")
+	if err := Checkout(context.Background(), s.Local, "", &log); err == nil || !strings.Contains(err.Error(), "topic") {
+		t.Errorf("Checkout(context.Background()) of a local only branch = %v", err)
+	}
+}
+
+func TestReuseLocalRemoteOrigin(t *testing.T) {
+	log := zerolog.Nop()
+	s, m, _ := pushFixture(t, false)
+	// a checkout of the remote itself. fetching its origin needs the credential
+	git(t, "-C", s.Local, "remote", "set-url", "origin", s.Remote)
+	other := filepath.Join(t.TempDir(), "other")
+	git(t, "clone", "-q", m.Path, other)
+	commit(t, other, "two")
+	git(t, "-C", other, "push", "-q", "origin", "main")
+
+	if err := m.CloneLocal(context.Background(), s.Local, LocalReuse, "", *NewHTTPSRemote(s.Remote), &log); err != nil {
+		t.Fatal(err)
+	}
+	if head, want := git(t, "-C", s.Local, "rev-parse", "HEAD"), refsOf(t, m.Path)["refs/heads/main"]; head != want {
+		t.Errorf("HEAD = %s, want the mirror main %s", head, want)
+	}
+	if origin := git(t, "-C", s.Local, "remote", "get-url", "origin"); origin != s.Remote {
+		t.Errorf("origin = %s", origin)
+	}
+}
+
+func TestCloneLocalUnbornHead(t *testing.T) {
+	log := zerolog.Nop()
+	empty := &Mirror{Path: filepath.Join(t.TempDir(), "empty.git")}
+	git(t, "init", "-q", "--bare", empty.Path)
+	_, m, _ := pushFixture(t, false)
+	git(t, "-C", m.Path, "symbolic-ref", "HEAD", "refs/heads/gone")
+	for _, mirror := range []*Mirror{empty, m} {
+		l := filepath.Join(t.TempDir(), "local")
+		if err := mirror.CloneLocal(context.Background(), l, LocalFail, "", HTTPSRemote{}, &log); err != nil {
+			t.Errorf("CloneLocal(%s) = %v", mirror.Path, err)
+		}
+	}
+	l := filepath.Join(t.TempDir(), "local")
+	if err := m.CloneLocal(context.Background(), l, LocalFail, "main", HTTPSRemote{}, &log); err != nil {
+		t.Errorf("CloneLocal(main) = %v", err)
+	}
+}
+
+func TestUpdateLocal(t *testing.T) {
+	log := zerolog.Nop()
+	tests := []struct {
+		name      string
+		hardReset bool
+		// changes the local repo after the mirror moved on
+		setup     func(t *testing.T, l string)
+		wantClass string
+		// HEAD is the mirror main afterwards
+		wantMirror bool
+	}{
+		{"fast-forward", false, func(*testing.T, string) {}, "", true},
+		{"local commit", false, func(t *testing.T, l string) { commit(t, l, "ours") }, ErrorClassGit, false},
+		{"hard reset", true, func(t *testing.T, l string) { commit(t, l, "ours") }, "", true},
+		// --hard-reset never discards uncommitted work
+		{"dirty tree", true, func(t *testing.T, l string) {
+			if err := os.WriteFile(filepath.Join(l, "new.txt"), []byte("x\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, ErrorClassDirty, false},
+		{"detached head", true, func(t *testing.T, l string) { git(t, "-C", l, "checkout", "-q", "--detach") }, ErrorClassGit, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, m, _ := pushFixture(t, false)
+			// someone else updates the mirror
+			other := filepath.Join(t.TempDir(), "other")
+			git(t, "clone", "-q", m.Path, other)
+			commit(t, other, "theirs")
+			git(t, "-C", other, "push", "-q", "origin", "main")
+			tt.setup(t, s.Local)
+			before := git(t, "-C", s.Local, "rev-parse", "HEAD")
+
+			err := m.UpdateLocal(context.Background(), s.Local, tt.hardReset, &log)
+			if ErrorClass(err) != tt.wantClass {
+				t.Fatalf("UpdateLocal() = %v, want class %q", err, tt.wantClass)
+			}
+			head := git(t, "-C", s.Local, "rev-parse", "HEAD")
+			if tt.wantMirror && head != refsOf(t, m.Path)["refs/heads/main"] {
+				t.Errorf("HEAD = %s, want the mirror main", head)
+			}
+			if !tt.wantMirror && head != before {
+				t.Errorf("HEAD moved from %s to %s", before, head)
+			}
+		})
+	}
+}
@@ -1,15 +1,29 @@
 package types
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/tracing"
 	"github.com/rs/zerolog"
 )
 
 // TODO: simplify mirriring by gettting rid of the struct and just using the functions
 
+// Mirror actions recorded by CreateClone and UpdateClone
+const (
+	MirrorCreated = "created"
+	MirrorUpdated = "updated"
+	MirrorReused  = "reused"
+)
+
 // Mirror is a struct that represents a git mirror
 // mirrors should never be pulled or cloned more than once
 // but tracking it makes it safe to run those functions multiple times
@@ -17,17 +31,35 @@ type Mirror struct {
 	IsCloned bool
 	IsPulled bool
 	Path     string
+	// modes and group for new mirror directories and files
+	Perms config.Permissions
+	// what the last CreateClone or UpdateClone did: created, updated or reused
+	Action string
+	// duration and size of the last clone or fetch from the remote
+	FetchDuration    time.Duration
+	BytesTransferred int64
+	// bundle store used to bootstrap new mirrors. nil clones from the remote
+	Bundles *BundleStore
+	// key of the bundle the mirror was created from, if any
+	Bundle string
+	// fork network whose object store the mirror shares, and the mirror root holding
+	// the stores. with DetectForks a mirror without one joins the network of its root commit
+	Network     string
+	DetectForks bool
+	Root        string
+	// normalized remote URL of a mirror in the hashed layout, for the index file
+	indexURL string
 }
 
 // CheckClone returns true if the mirror is cloned
 // it also sets the IsCloned flag. Use this to avoid rerunning git commands
-func (m Mirror) CheckClone(log *zerolog.Logger) bool {
+func (m *Mirror) CheckClone(ctx context.Context, log *zerolog.Logger) bool {
 	// if this is set to true, we don't need to check again
 	if m.IsCloned {
 		log.Debug().Msgf("already confirmed the mirror is cloned: %s", m.Path)
 		return true
 	}
-	result, _ := config.Run([]string{"git", "-C", m.Path, "rev-parse", "--is-bare-repository"})
+	result, _ := config.Run(ctx, []string{"git", "-C", m.Path, "rev-parse", "--is-bare-repository"})
 	if result.ReturnCode != 0 || result.StdOut != "true\n" {
 		log.Debug().Msgf("mirror is not cloned: %s", result.String())
 		m.IsCloned = false
@@ -39,90 +71,269 @@ func (m Mirror) CheckClone(log *zerolog.Logger) bool {
 }
 
 // CreateClone creates a mirror of a remote repo
-func (m Mirror) CreateClone(r HTTPSRemote, c Credential, log *zerolog.Logger) {
+func (m *Mirror) CreateClone(ctx context.Context, r HTTPSRemote, c Credential, log *zerolog.Logger) (err error) {
+	ctx, span := tracing.Start(ctx, "mirror.create")
+	defer func() { m.finishSpan(span, err) }()
 	mirrorParent := path.Dir(m.Path)
 
-	result, err := config.Run([]string{"mkdir", "-p", mirrorParent})
-	if err != nil || result.ReturnCode != 0 {
-		log.Fatal().Err(err).Msg(result.String())
+	if err = m.Perms.MkdirAll(mirrorParent); err != nil {
+		return &Error{Class: ErrorClassFilesystem, Msg: "unable to create mirror parent " + mirrorParent, Err: err}
 	}
-	log.Debug().Msgf("cloning mirror to : %s", m.Path)
-	result, err = config.Run([]string{"git", "-C", mirrorParent, "clone", "--mirror", r.ConnectionString(c)})
-	if err != nil {
-		log.Fatal().Err(err).Msg(result.String())
+	if err = c.Refresh(log); err != nil {
+		return &Error{Class: ErrorClassCredential, Msg: "unable to refresh credential", Err: err}
 	}
-
+	start := time.Now()
+	var result config.Result
+	if m.bootstrap(ctx, r, log) {
+		// only the changes since the bundle come from the remote
+		if err = m.setRemote(ctx, r, &c, log); err != nil {
+			return err
+		}
+		result, err = runGit(ctx, c, "-C", m.Path, "fetch", "--prune", "--progress", "origin")
+		if err != nil || result.ReturnCode != 0 {
+			return gitError("unable to update mirror "+m.Path+" from bundle", result, err)
+		}
+	} else {
+		log.Debug().Msgf("cloning mirror to : %s", m.Path)
+		args := []string{"-C", mirrorParent, "clone", "--mirror", "--progress"}
+		if shared := m.Perms.SharedRepository(); shared != "" {
+			// git applies the mode to the objects and refs it writes later too
+			args = append(args, "--config", "core.sharedRepository="+shared)
+		}
+		result, err = runGit(ctx, c, append(args, "--", r.ConnectionString(), m.Path)...)
+		if err != nil || result.ReturnCode != 0 {
+			return gitError("unable to clone mirror "+m.Path, result, err)
+		}
+	}
+	if m.Perms.SharedRepository() != "" {
+		if err = m.Perms.ChmodTree(m.Path); err != nil {
+			return &Error{Class: ErrorClassFilesystem, Msg: "unable to set mirror permissions", Err: err}
+		}
+	}
+	m.recordFetch(MirrorCreated, start, result)
+	if err := m.markFetched(); err != nil {
+		log.Warn().Err(err).Msgf("unable to record fetch time of %s", m.Path)
+	}
+	if err := m.recordIndex(); err != nil {
+		log.Warn().Err(err).Msgf("unable to add %s to the mirror index", m.Path)
+	}
+	// the mirror works without the shared store, just bigger
+	if err := m.JoinNetwork(ctx, log); err != nil {
+		log.Warn().Err(err).Msgf("unable to add %s to fork network %s", m.Path, m.Network)
+	}
+	m.IsCloned = true
+	m.IsPulled = true
+	return nil
 }
 
 // UpdateClone updates the mirror with the latest changes
-func (m Mirror) UpdateClone(log *zerolog.Logger) {
+// The mirror remote URL is reset first so an expired or rotated token isn't reused
+func (m *Mirror) UpdateClone(ctx context.Context, r HTTPSRemote, c Credential, log *zerolog.Logger) (err error) {
+	ctx, span := tracing.Start(ctx, "mirror.update")
+	defer func() { m.finishSpan(span, err) }()
 	if m.IsPulled {
 		log.Debug().Msgf("mirror is already pulled: %s", m.Path)
-		return
+		return nil
 	}
+	if err := m.setRemote(ctx, r, &c, log); err != nil {
+		return err
+	}
+	before := m.refs(ctx)
 	log.Debug().Msgf("mirror exists at : %s. Pulling latest", m.Path)
-	result, err := config.Run([]string{"git", "-C", m.Path, "fetch", "--all"})
-	if err != nil {
-		log.Fatal().Err(err).Msg(result.String())
+	start := time.Now()
+	result, err := runGit(ctx, c, "-C", m.Path, "fetch", "--all", "--progress")
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to update mirror "+m.Path, result, err)
+	}
+	action := MirrorUpdated
+	if m.refs(ctx) == before {
+		action = MirrorReused
+	}
+	m.recordFetch(action, start, result)
+	if err := m.markFetched(); err != nil {
+		log.Warn().Err(err).Msgf("unable to record fetch time of %s", m.Path)
 	}
 	m.IsPulled = true
+	return nil
+}
+
+// IsFresh returns true if every ref on the remote is in the mirror at the same commit
+// It only lists the remote refs, so it is cheaper than a fetch and doesn't write to the mirror
+func (m *Mirror) IsFresh(ctx context.Context, r HTTPSRemote, c Credential, log *zerolog.Logger) (bool, error) {
+	if err := c.Refresh(log); err != nil {
+		return false, &Error{Class: ErrorClassCredential, Msg: "unable to refresh credential", Err: err}
+	}
+	result, err := runGit(ctx, c, "ls-remote", "--", r.ConnectionString())
+	if err != nil || result.ReturnCode != 0 {
+		return false, gitError("unable to list remote refs", result, err)
+	}
+	local, err := m.refValues(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(result.StdOut), "\n") {
+		fields := strings.Fields(line)
+		// HEAD and peeled tags aren't refs in the mirror
+		if len(fields) != 2 || fields[1] == "HEAD" || strings.HasSuffix(fields[1], "^{}") {
+			continue
+		}
+		if local[fields[1]] != fields[0] {
+			log.Debug().Msgf("mirror %s is stale: %s", m.Path, fields[1])
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// finishSpan records the mirror attributes and ends the span
+func (m *Mirror) finishSpan(span *tracing.Span, err error) {
+	span.SetAttribute("mirror.path", m.Path)
+	span.SetAttribute("mirror.action", m.Action)
+	span.SetAttribute("mirror.fetch_duration_seconds", m.FetchDuration.Seconds())
+	span.SetAttribute("mirror.bytes_transferred", m.BytesTransferred)
+	span.Finish(err)
+}
+
+// receivedPattern matches the final git progress line for received objects
+var receivedPattern = regexp.MustCompile(`Receiving objects: 100% \(\d+/\d+\), ([\d.]+) (bytes|KiB|MiB|GiB)`)
+
+// recordFetch saves the action, duration and transfer size of a clone or fetch
+func (m *Mirror) recordFetch(action string, start time.Time, result config.Result) {
+	m.Action = action
+	m.FetchDuration = time.Since(start)
+	m.BytesTransferred = 0
+	matches := receivedPattern.FindAllStringSubmatch(result.StdErr, -1)
+	if len(matches) == 0 {
+		return
+	}
+	last := matches[len(matches)-1]
+	size, err := strconv.ParseFloat(last[1], 64)
+	if err != nil {
+		return
+	}
+	units := map[string]float64{"bytes": 1, "KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30}
+	m.BytesTransferred = int64(size * units[last[2]])
+}
+
+// refs returns all the mirror refs and their commits, so fetches can be compared
+func (m *Mirror) refs(ctx context.Context) string {
+	result, _ := config.Run(ctx, []string{"git", "-C", m.Path, "for-each-ref", "--format=%(objectname) %(refname)"})
+	return result.StdOut
+}
+
+// setRemote refreshes the credential and sets the mirror origin URL
+// An origin with the userinfo of an older version is replaced too
+func (m *Mirror) setRemote(ctx context.Context, r HTTPSRemote, c *Credential, log *zerolog.Logger) error {
+	if err := c.Refresh(log); err != nil {
+		return &Error{Class: ErrorClassCredential, Msg: "unable to refresh credential", Err: err}
+	}
+	log.Debug().Msgf("setting mirror remote URL: %s", m.Path)
+	result, err := config.Run(ctx, []string{"git", "-C", m.Path, "remote", "set-url", "--", "origin", r.ConnectionString()})
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to set mirror remote URL", result, err)
+	}
+	return nil
+}
+
+// runGit runs git with the credential environment
+func runGit(ctx context.Context, c Credential, args ...string) (config.Result, error) {
+	return config.RunEnv(ctx, c.GitEnv(), append([]string{"git"}, args...))
 }
 
 // MakeLocal creates a local clone from the mirror
-func (m Mirror) MakeLocal(l string, log *zerolog.Logger) {
+func (m *Mirror) MakeLocal(ctx context.Context, l string, log *zerolog.Logger) (err error) {
+	ctx, span := tracing.Start(ctx, "local.clone")
+	span.SetAttribute("local.path", l)
+	defer func() { span.Finish(err) }()
 	localParent := path.Dir(l)
 	log.Debug().Msgf("Ensuring local parent path: %s", localParent)
-	result, err := config.Run([]string{"mkdir", "-p", localParent})
-	if err != nil || result.ReturnCode != 0 {
-		log.Fatal().Err(err).Msg(result.String())
+	// the working copy belongs to the build user, so it follows the umask
+	if err = os.MkdirAll(localParent, 0777); err != nil {
+		return &Error{Class: ErrorClassFilesystem, Msg: "unable to create local parent " + localParent, Err: err}
 	}
 	log.Debug().Msgf("Creating local clone(%s) from mirror(%s)", l, m.Path)
-	result, err = config.Run([]string{"git", "clone", m.Path, l})
-	if err != nil {
-		log.Fatal().Err(err).Msg(result.String())
+	result, err := config.Run(ctx, []string{"git", "clone", "--", m.Path, l})
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to clone local repo "+l, result, err)
+	}
+	return nil
+}
+
+// HeadCommit returns the commit SHA checked out in a local repo
+func HeadCommit(ctx context.Context, local string) (string, error) {
+	result, err := config.Run(ctx, []string{"git", "-C", local, "rev-parse", "HEAD"})
+	if err != nil || result.ReturnCode != 0 {
+		return "", gitError("unable to get HEAD commit of "+local, result, err)
 	}
+	return strings.TrimSpace(result.StdOut), nil
 }
 
 // NewMirror returns a new Mirror struct
+// Invalid permission settings fall back to the defaults. CheckMirrorRoot reports them
+// It panics if the remote is invalid or its mirror would be outside the mirror root.
+// NewRemote refuses those remotes, so check untrusted remotes with it first
 func NewMirror(s config.Settings, log *zerolog.Logger) *Mirror {
-	remote := NewHTTPSRemote(s.Remote)
+	raw := NewHTTPSRemote(s.Remote)
+	remote := raw.Normalize(s)
+	perms, err := config.ParsePermissions(s)
+	if err != nil {
+		log.Warn().Err(err).Msg("using default mirror permissions")
+		perms, _ = config.ParsePermissions(config.Settings{})
+	}
+	if s.MirrorLayout == LayoutHashed {
+		return &Mirror{
+			Path:        path.Join(s.Mirror, HashedName(*remote)),
+			Perms:       perms,
+			Bundles:     NewBundleStore(s, log),
+			Network:     ConfiguredNetwork(s, *remote),
+			DetectForks: s.DetectForks,
+			Root:        s.Mirror,
+			indexURL:    remote.URL.String(),
+		}
+	}
+	p, err := MirrorPath(s.Mirror, *remote)
+	if err != nil {
+		panic(err)
+	}
+	// a mirror created before remotes were normalized keeps its path
+	if legacy, err := MirrorPath(s.Mirror, *raw); err == nil && legacy != p && !isDir(p) && isDir(legacy) {
+		log.Debug().Msgf("using mirror %s for %s", legacy, p)
+		p = legacy
+	}
 
 	return &Mirror{
-		IsCloned: false,
-		IsPulled: false,
-		Path:     config.JoinPaths(s.Mirror, remote.Host, remote.Path),
+		IsCloned:    false,
+		IsPulled:    false,
+		Path:        p,
+		Perms:       perms,
+		Bundles:     NewBundleStore(s, log),
+		Network:     ConfiguredNetwork(s, *remote),
+		DetectForks: s.DetectForks,
+		Root:        s.Mirror,
 	}
 }
 
-// PushMirror pushes the mirror to the remote
-func PushMirror(s config.Settings, log *zerolog.Logger) {
-	mirror := *NewMirror(s, log)
-	log.Debug().Msgf("Checking status of local repo: %s", s.Local)
-	result, err := config.Run([]string{"git", "-C", s.Local, "status", "--short"})
-	if err != nil || result.ReturnCode != 0 || result.StdOut != "" {
-		log.Error().Msgf("Unable to push dirty repo: %s", s.Local)
-		log.Fatal().Err(err).Msg(result.String())
-	}
-
-	// Get the current branch name so we can push it
-	log.Debug().Msgf("Get current branch of local repo: %s", s.Local)
-	result, _ = config.Run([]string{"git", "-C", s.Local, "branch", "--show-current"})
-	branch := strings.TrimSuffix(result.StdOut, "\n")
-	log.Info().Msgf("Got current branch of local repo (%s): %s", s.Local, branch)
-
-	//Push the current local branch to the mirror
-	log.Debug().Msgf("Pushing local repo(%s) to mirror(%s)", s.Local, mirror.Path)
-	result, err = config.Run([]string{"git", "-C", s.Local, "push", "--set-upstream", "origin", branch})
-	if err != nil || result.ReturnCode != 0 {
-		log.Error().Msgf("Unable to push local repo (%s) to mirror (%s)", s.Local, mirror.Path)
-		log.Fatal().Err(err).Msg(result.String())
+// CheckMirrorRoot validates the permission and fork network settings and that the
+// mirror root can be written before any git command runs
+func CheckMirrorRoot(s config.Settings) error {
+	if err := CheckForkNetworks(s); err != nil {
+		return err
 	}
-
-	// Push the mirror to the remote
-	log.Debug().Msgf("Pushing mirror(%s) to remote(%s)", mirror.Path, s.Remote)
-	result, _ = config.Run([]string{"git", "-C", mirror.Path, "push"})
-	if err != nil || result.ReturnCode != 0 || result.StdOut != "" {
-		log.Error().Msgf("Unable to push mirror (%s) to remote (%s)", mirror.Path, s.Remote)
-		log.Fatal().Err(err).Msg(result.String())
+	perms, err := config.ParsePermissions(s)
+	if err == nil && s.MirrorLayout != "" && s.MirrorLayout != LayoutPath && s.MirrorLayout != LayoutHashed {
+		err = fmt.Errorf("unknown mirror layout %s", s.MirrorLayout)
+	}
+	if err == nil {
+		err = perms.CheckWritable(s.Mirror)
 	}
+	if err != nil {
+		return &Error{Class: ErrorClassFilesystem, Msg: "mirror root check failed", Err: err}
+	}
+	return nil
+}
+
+// isDir returns true if p is a directory
+func isDir(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
 }
@@ -1,10 +1,17 @@
 package types
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -47,7 +54,7 @@ func writeStringToFile(filePath string) error {
 
 // checkoutNewBranch checks out a test branch
 func checkoutNewBranch(s config.Settings, log *zerolog.Logger) {
-	result, err := config.Run(
+	result, err := config.Run(context.Background(),
 		[]string{"git", "-C", s.Local, "checkout", "-b", fmt.Sprintf("cache_clone_%s", currentTime)})
 	if err != nil || result.ReturnCode != 0 || result.StdOut != "" {
 		log.Error().Msgf("Unable to checkout new branch: %s", result.String())
@@ -57,13 +64,13 @@ func checkoutNewBranch(s config.Settings, log *zerolog.Logger) {
 
 // commitNewBranch commits a test branch
 func commitNewBranch(s config.Settings, log *zerolog.Logger) {
-	result, err := config.Run(
+	result, err := config.Run(context.Background(),
 		[]string{"git", "-C", s.Local, "add", testFile})
 	if err != nil || result.ReturnCode != 0 || result.StdOut != "" {
 		log.Error().Msgf("Unable to add new branch: %s", result.String())
 		log.Fatal().Err(err).Msg(result.String())
 	}
-	result, err = config.Run(
+	result, err = config.Run(context.Background(),
 		[]string{"git", "-C", s.Local, "commit", "-m", fmt.Sprintf("cache_clone_%s", currentTime)})
 	if err != nil || result.ReturnCode != 0 || result.StdErr != "" {
 		log.Error().Msgf("Unable to commit new branch: %s", result.String())
@@ -86,22 +93,84 @@ func TestClone(t *testing.T) {
 	// create a new mirror
 	m := NewMirror(s, &log)
 	// confirm the mirror is not cloned
-	if m.CheckClone(&log) {
+	if m.CheckClone(context.Background(), &log) {
 		t.Fatalf("Mirror should not be cloned yet")
 	}
 	// create the mirror
 	// this works with empty credentials because the repo is public
 	// and obviates the need for AWS Secret Manager access
-	m.CreateClone(*NewHTTPSRemote(s.Remote), Credential{}, &log)
+	if err := m.CreateClone(context.Background(), *NewHTTPSRemote(s.Remote), Credential{}, &log); err != nil {
+		t.Fatal(err)
+	}
 	// confirm the mirror is cloned
-	if !m.CheckClone(&log) {
+	if !m.CheckClone(context.Background(), &log) {
 		t.Fatalf("Mirror should be cloned")
 
 	}
 	// update the mirror
-	m.UpdateClone(&log)
+	if err := m.UpdateClone(context.Background(), *NewHTTPSRemote(s.Remote), Credential{}, &log); err != nil {
+		t.Fatal(err)
+	}
 	// clone the mirror locally
-	m.MakeLocal(filepath.Join(s.Mirror, "local"), &log)
+	if err := m.MakeLocal(context.Background(), filepath.Join(s.Mirror, "local"), &log); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCloneCredential checks the basic credential reaches the server in a header and
+// never lands in the mirror config
+func TestCloneCredential(t *testing.T) {
+	log := zerolog.Nop()
+	repos, work := t.TempDir(), t.TempDir()
+	git(t, "init", "-q", "-b", "main", work)
+	commit(t, work, "one")
+	git(t, "clone", "-q", "--bare", work, filepath.Join(repos, "org", "repo.git"))
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("no git")
+	}
+	backend := &cgi.Handler{
+		Path:   gitPath,
+		Args:   []string{"http-backend"},
+		Env:    []string{"GIT_PROJECT_ROOT=" + repos, "GIT_HTTP_EXPORT_ALL=1"},
+		Stderr: io.Discard,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, token, ok := r.BasicAuth(); strings.HasPrefix(r.URL.Path, "/org/") && (!ok || user != "bob" || token != "s3cr3t-tok") {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	t.Setenv("GIT_TERMINAL_PROMPT", "0")
+
+	remote := *NewHTTPSRemote(srv.URL + "/org/repo.git")
+	// an origin with userinfo from an older version is replaced by the next fetch
+	legacy := *NewHTTPSRemote(strings.Replace(srv.URL, "://", "://bob:s3cr3t-tok@", 1) + "/org/repo.git")
+	c := Credential{Type: BasicCredential, Username: "bob", Token: "s3cr3t-tok"}
+	for _, r := range []HTTPSRemote{remote, legacy} {
+		m := NewMirror(config.Settings{Mirror: t.TempDir(), Remote: r.URL.String()}, &log)
+		if err := m.CreateClone(context.Background(), r, c, &log); err != nil {
+			t.Fatal(err)
+		}
+		git(t, "-C", m.Path, "remote", "set-url", "origin", legacy.URL.String())
+		m.IsPulled = false
+		if err := m.UpdateClone(context.Background(), r, c, &log); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(m.Path, "config"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "s3cr3t-tok") || strings.Contains(string(data), ":@") {
+			t.Errorf("mirror config has userinfo:\n%s", data)
+		}
+	}
+	if err := NewMirror(config.Settings{Mirror: t.TempDir(), Remote: remote.URL.String()}, &log).CreateClone(context.Background(), remote, Credential{}, &log); err == nil {
+		t.Error("CreateClone() without the credential succeeded")
+	}
 }
 
 // TestCloneAndPush tests the push function
@@ -125,25 +194,34 @@ func TestCloneAndPush(t *testing.T) {
 	// create a new mirror
 	m := NewMirror(s, &log)
 	// confirm the mirror is not cloned
-	if m.CheckClone(&log) {
+	if m.CheckClone(context.Background(), &log) {
 		t.Fatalf("Mirror should not be cloned yet")
 	}
 	// create the mirror
 	// this works with empty credentials because the repo is public
 	// and obviates the need for AWS Secret Manager access
-	m.CreateClone(*NewHTTPSRemote(s.Remote), *NewCredential(s, &log), &log)
+	creds := *NewCredential(s, &log)
+	if err := m.CreateClone(context.Background(), *NewHTTPSRemote(s.Remote), creds, &log); err != nil {
+		t.Fatal(err)
+	}
 	// confirm the mirror is cloned
-	if !m.CheckClone(&log) {
+	if !m.CheckClone(context.Background(), &log) {
 		t.Fatalf("Mirror should be cloned")
 
 	}
 	// update the mirror
-	m.UpdateClone(&log)
+	if err := m.UpdateClone(context.Background(), *NewHTTPSRemote(s.Remote), creds, &log); err != nil {
+		t.Fatal(err)
+	}
 	// clone the mirror locallyz
-	m.MakeLocal(s.Local, &log)
+	if err := m.MakeLocal(context.Background(), s.Local, &log); err != nil {
+		t.Fatal(err)
+	}
 	// checkout a branch for the test
 	checkoutNewBranch(s, &log)
 	writeStringToFile(filepath.Join(s.Local, testFile))
 	commitNewBranch(s, &log)
-	PushMirror(s, &log)
+	if _, err := PushMirror(context.Background(), s, nil, &log); err != nil {
+		t.Fatal(err)
+	}
 }
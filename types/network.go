@@ -0,0 +1,243 @@
+package types
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/tracing"
+	"github.com/rs/zerolog"
+)
+
+// NetworksDir holds the shared object store of each fork network in the mirror root
+// <root>/cache_clone.networks/<network>.git
+const NetworksDir = "cache_clone.networks"
+
+// networkPattern matches a fork network name
+var networkPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// NetworkStore returns the path of the shared object store of a fork network
+func NetworkStore(root, network string) string {
+	return filepath.Join(root, NetworksDir, network+".git")
+}
+
+// NetworkStores returns the object stores of all fork networks in the mirror root
+func NetworkStores(root string) ([]string, error) {
+	stores, err := filepath.Glob(filepath.Join(root, NetworksDir, "*.git"))
+	sort.Strings(stores)
+	return stores, err
+}
+
+// CheckForkNetworks validates the remote URL and network name of each --fork-network
+func CheckForkNetworks(s config.Settings) error {
+	for remote, network := range s.ForkNetworks {
+		if _, err := NewRemote(remote); err != nil {
+			return &Error{Class: ErrorClassUnknown, Msg: "invalid --fork-network remote " + config.Redact(remote), Err: err}
+		}
+		if !networkPattern.MatchString(network) {
+			return &Error{Class: ErrorClassUnknown, Msg: "invalid --fork-network name " + network}
+		}
+	}
+	return nil
+}
+
+// ConfiguredNetwork returns the fork network --fork-network assigns to a normalized remote. "" if none
+// Invalid entries are skipped. CheckForkNetworks reports them
+func ConfiguredNetwork(s config.Settings, r HTTPSRemote) string {
+	for remote, network := range s.ForkNetworks {
+		n, err := NewRemote(remote)
+		if err != nil || !networkPattern.MatchString(network) {
+			continue
+		}
+		if n = n.Normalize(s); n.Host == r.Host && n.Path == r.Path {
+			return network
+		}
+	}
+	return ""
+}
+
+// Alternate returns the object directory the mirror borrows objects from. "" if none
+func (m *Mirror) Alternate() string {
+	data, err := os.ReadFile(filepath.Join(m.Path, "objects", "info", "alternates"))
+	if err != nil {
+		return ""
+	}
+	lines := strings.Fields(string(data))
+	if len(lines) == 0 {
+		return ""
+	}
+	return lines[0]
+}
+
+// SharedNetwork returns the fork network whose object store the mirror borrows from. "" if none
+func (m *Mirror) SharedNetwork() string {
+	store := filepath.Dir(m.Alternate())
+	if filepath.Base(filepath.Dir(store)) != NetworksDir {
+		return ""
+	}
+	return strings.TrimSuffix(filepath.Base(store), ".git")
+}
+
+// rootCommit returns the first root commit of the mirror HEAD. forks share it with their upstream
+func (m *Mirror) rootCommit(ctx context.Context) (string, error) {
+	result, err := config.Run(ctx, []string{"git", "-C", m.Path, "rev-list", "--max-parents=0", "HEAD"})
+	if err != nil || result.ReturnCode != 0 {
+		return "", gitError("unable to find the root commit of "+m.Path, result, err)
+	}
+	roots := strings.Fields(result.StdOut)
+	if len(roots) == 0 {
+		return "", &Error{Class: ErrorClassGit, Msg: "no root commit in " + m.Path}
+	}
+	sort.Strings(roots)
+	return roots[0], nil
+}
+
+// JoinNetwork moves the objects the mirror shares with its fork network into the
+// network object store and makes the mirror borrow them from it with git alternates.
+// The network is m.Network, else the one it is in, else the root commit with DetectForks.
+// A mirror without a network, or already in it, is left alone
+func (m *Mirror) JoinNetwork(ctx context.Context, log *zerolog.Logger) error {
+	if m.Root == "" {
+		return nil
+	}
+	if m.Network == "" {
+		m.Network = m.SharedNetwork()
+	}
+	if m.Network == "" && m.DetectForks {
+		root, err := m.rootCommit(ctx)
+		if err != nil {
+			// an empty mirror has nothing to share yet
+			log.Debug().Err(err).Msgf("no fork network for %s", m.Path)
+			return nil
+		}
+		m.Network = root
+	}
+	if m.Network == "" {
+		return nil
+	}
+	if !networkPattern.MatchString(m.Network) {
+		return &Error{Class: ErrorClassUnknown, Msg: "invalid fork network name " + m.Network}
+	}
+	store := NetworkStore(m.Root, m.Network)
+	objects := filepath.Join(store, "objects")
+	switch alternate := m.Alternate(); alternate {
+	case objects:
+		return nil
+	case "":
+	default:
+		return &Error{Class: ErrorClassFilesystem, Msg: fmt.Sprintf("%s already borrows objects from %s", m.Path, alternate)}
+	}
+	if err := m.initStore(ctx, store); err != nil {
+		return err
+	}
+	if err := m.syncToStore(ctx, store); err != nil {
+		return err
+	}
+	// every object the mirror refs reach is in the store now
+	if err := m.writeStamp(filepath.Join(m.Path, "objects", "info", "alternates"), []byte(objects+"\n")); err != nil {
+		return &Error{Class: ErrorClassFilesystem, Msg: "unable to write alternates of " + m.Path, Err: err}
+	}
+	log.Debug().Msgf("%s borrows objects from %s", m.Path, store)
+	return m.repackLocal(ctx)
+}
+
+// initStore creates the object store of a fork network
+// Members borrow objects no store ref reaches anymore, so git never prunes it.
+// Fetched objects stay packed, so prune-packed removes them from the members
+func (m *Mirror) initStore(ctx context.Context, store string) error {
+	if isDir(store) {
+		return nil
+	}
+	if err := m.Perms.MkdirAll(filepath.Dir(store)); err != nil {
+		return &Error{Class: ErrorClassFilesystem, Msg: "unable to create " + filepath.Dir(store), Err: err}
+	}
+	args := []string{"git", "init", "--quiet", "--bare"}
+	if shared := m.Perms.SharedRepository(); shared != "" {
+		args = append(args, "--shared="+shared)
+	}
+	result, err := config.Run(ctx, append(args, "--", store))
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to create network object store "+store, result, err)
+	}
+	for _, kv := range [][]string{{"gc.auto", "0"}, {"gc.pruneExpire", "never"}, {"fetch.unpackLimit", "1"}, {"repack.writeBitmaps", "false"}} {
+		result, err = config.Run(ctx, []string{"git", "-C", store, "config", kv[0], kv[1]})
+		if err != nil || result.ReturnCode != 0 {
+			return gitError("unable to configure network object store "+store, result, err)
+		}
+	}
+	return nil
+}
+
+// syncToStore fetches the mirror refs into refs/forks/<mirror>/ of the network store,
+// so the store keeps every object the mirror borrows
+func (m *Mirror) syncToStore(ctx context.Context, store string) error {
+	remote, err := m.Remote(ctx)
+	if err != nil {
+		return err
+	}
+	key := strings.TrimSuffix(HashedName(*remote.Normalize(config.Settings{})), ".git")
+	result, err := config.Run(ctx, []string{"git", "-C", store, "fetch", "--quiet", "--prune", "--no-tags", "--", m.Path, "+refs/*:refs/forks/" + key + "/*"})
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to copy objects of "+m.Path+" to "+store, result, err)
+	}
+	return nil
+}
+
+// repackLocal packs the objects of the mirror that aren't in its alternate and removes the rest
+func (m *Mirror) repackLocal(ctx context.Context) error {
+	result, err := config.Run(ctx, []string{"git", "-C", m.Path, "repack", "-a", "-d", "-l", "-q"})
+	if err == nil && result.ReturnCode == 0 {
+		result, err = config.Run(ctx, []string{"git", "-C", m.Path, "prune-packed"})
+	}
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to repack "+m.Path, result, err)
+	}
+	return nil
+}
+
+// GC compacts the mirror. A mirror that belongs to a fork network joins it first. Its
+// refs are copied to the network store before the repack, and objects in the store are
+// removed from the mirror. Plain mirrors run git gc
+func (m *Mirror) GC(ctx context.Context, log *zerolog.Logger) (err error) {
+	ctx, span := tracing.Start(ctx, "mirror.gc")
+	span.SetAttribute("mirror.path", m.Path)
+	defer func() {
+		span.SetAttribute("mirror.network", m.SharedNetwork())
+		span.Finish(err)
+	}()
+	if err := m.JoinNetwork(ctx, log); err != nil {
+		return err
+	}
+	if m.SharedNetwork() == "" {
+		result, err := config.Run(ctx, []string{"git", "-C", m.Path, "gc", "--quiet"})
+		if err != nil || result.ReturnCode != 0 {
+			return gitError("unable to gc "+m.Path, result, err)
+		}
+		return nil
+	}
+	if err := m.syncToStore(ctx, filepath.Dir(m.Alternate())); err != nil {
+		return err
+	}
+	return m.repackLocal(ctx)
+}
+
+// GCNetwork repacks a network object store into one pack
+// Unreachable objects stay: a member can borrow an object after its fork ref moved on
+func GCNetwork(ctx context.Context, store string) (err error) {
+	ctx, span := tracing.Start(ctx, "network.gc")
+	span.SetAttribute("mirror.path", store)
+	defer func() { span.Finish(err) }()
+	result, err := config.Run(ctx, []string{"git", "-C", store, "repack", "-a", "-d", "-q", "--keep-unreachable"})
+	if err == nil && result.ReturnCode == 0 {
+		result, err = config.Run(ctx, []string{"git", "-C", store, "pack-refs", "--all"})
+	}
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to repack network object store "+store, result, err)
+	}
+	return nil
+}
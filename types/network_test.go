@@ -0,0 +1,99 @@
+package types
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/rs/zerolog"
+)
+
+func TestForkNetwork(t *testing.T) {
+	log := zerolog.Nop()
+	root := t.TempDir()
+	work := t.TempDir()
+	git(t, "-C", work, "init", "-q")
+	git(t, "-C", work, "-c", "user.name=a", "-c", "user.email=a@b", "commit", "-q", "--allow-empty", "-m", "one")
+	git(t, "-C", work, "-c", "user.name=a", "-c", "user.email=a@b", "commit", "-q", "--allow-empty", "-m", "two")
+
+	s := config.Settings{Mirror: root, DetectForks: true, ForkNetworks: map[string]string{"https://host/bob/app": "app"}}
+	var mirrors []*Mirror
+	for _, remote := range []string{"https://host/org/app.git", "https://host/alice/app.git"} {
+		s.Remote = remote
+		m := NewMirror(s, &log)
+		git(t, "clone", "-q", "--mirror", work, m.Path)
+		git(t, "-C", m.Path, "remote", "set-url", "origin", remote)
+		if err := m.JoinNetwork(context.Background(), &log); err != nil {
+			t.Fatal(err)
+		}
+		mirrors = append(mirrors, m)
+	}
+	s.Remote = "https://HOST/bob/app.git"
+	if m := NewMirror(s, &log); m.Network != "app" {
+		t.Errorf("configured network = %q", m.Network)
+	}
+
+	rootCommit, _ := mirrors[0].rootCommit(context.Background())
+	store := NetworkStore(root, rootCommit)
+	for _, m := range mirrors {
+		if m.Network != rootCommit || m.SharedNetwork() != rootCommit || m.Alternate() != filepath.Join(store, "objects") {
+			t.Errorf("%s network = %s, alternate = %s", m.Path, m.Network, m.Alternate())
+		}
+		if count := git(t, "-C", m.Path, "count-objects", "-v"); !strings.Contains(count, "count: 0") || !strings.Contains(count, "in-pack: 0") {
+			t.Errorf("%s kept objects that are in the network store:\n%s", m.Path, count)
+		}
+	}
+	if refs := git(t, "-C", store, "for-each-ref", "refs/forks/"); strings.Count(refs, "refs/forks/") != 2 {
+		t.Errorf("network store refs:\n%s", refs)
+	}
+
+	// a commit only one fork has stays in that fork until gc copies it to the store
+	git(t, "-C", work, "-c", "user.name=a", "-c", "user.email=a@b", "commit", "-q", "--allow-empty", "-m", "three")
+	git(t, "-C", mirrors[1].Path, "fetch", "-q", "--", work, "+refs/heads/*:refs/heads/*")
+	for _, m := range mirrors {
+		if err := m.GC(context.Background(), &log); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := GCNetwork(context.Background(), store); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mirrors {
+		git(t, "-C", m.Path, "fsck", "--no-dangling")
+		if count := git(t, "-C", m.Path, "count-objects", "-v"); !strings.Contains(count, "in-pack: 0") {
+			t.Errorf("%s after gc:\n%s", m.Path, count)
+		}
+	}
+	if stores, _ := NetworkStores(root); len(stores) != 1 || stores[0] != store {
+		t.Errorf("NetworkStores() = %v", stores)
+	}
+
+	s.Remote = "https://host/org/app.git"
+	s.ForkNetworks = map[string]string{s.Remote: "other"}
+	if err := NewMirror(s, &log).JoinNetwork(context.Background(), &log); err == nil {
+		t.Error("JoinNetwork() moved a mirror to another network")
+	}
+	if out, err := exec.Command("git", "clone", "-q", "--", mirrors[1].Path, filepath.Join(t.TempDir(), "local")).CombinedOutput(); err != nil {
+		t.Errorf("local clone of a network mirror: %v %s", err, out)
+	}
+}
+
+func TestCheckForkNetworks(t *testing.T) {
+	r := HTTPSRemote{Host: "host", Path: "/org/app.git"}
+	for _, networks := range []map[string]string{{"foo": "app"}, {"https://host/org/app.git": "../app"}, {"https://host/org/app.git": ""}} {
+		s := config.Settings{ForkNetworks: networks}
+		if err := CheckForkNetworks(s); ErrorClass(err) != ErrorClassUnknown {
+			t.Errorf("CheckForkNetworks(%v) = %v", networks, err)
+		}
+		if got := ConfiguredNetwork(s, r); got != "" {
+			t.Errorf("ConfiguredNetwork(%v) = %s", networks, got)
+		}
+	}
+	s := config.Settings{ForkNetworks: map[string]string{"foo": "x", "https://HOST/org/app": "app"}}
+	if got := ConfiguredNetwork(s, r); got != "app" {
+		t.Errorf("ConfiguredNetwork() = %q, want app", got)
+	}
+}
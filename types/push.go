@@ -0,0 +1,576 @@
+package types
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/natemarks/cache_clone/tracing"
+	"github.com/rs/zerolog"
+)
+
+// Push hops
+const (
+	HopMirror = "mirror"
+	HopRemote = "remote"
+)
+
+// Ref push statuses, from the git push --porcelain flags
+const (
+	RefNew      = "new"
+	RefUpdated  = "updated"
+	RefForced   = "forced"
+	RefDeleted  = "deleted"
+	RefUpToDate = "up_to_date"
+	RefRejected = "rejected"
+	// a mirror ref restored after the remote rejected it
+	RefRolledBack = "rolled_back"
+)
+
+// Rejection reasons, from the git push --porcelain summary
+const (
+	RejectNonFastForward = "non_fast_forward"
+	RejectPermission     = "permission"
+	RejectHook           = "hook"
+	RejectOther          = "other"
+)
+
+// RefResult is the result of pushing one ref in one hop
+type RefResult struct {
+	Hop     string `json:"hop"`
+	Source  string `json:"source,omitempty"`
+	Ref     string `json:"ref"`
+	Status  string `json:"status"`
+	Summary string `json:"summary,omitempty"`
+	// why a rejected ref was refused
+	Reason string `json:"reason,omitempty"`
+}
+
+// PushMirror pushes local refs to the mirror and then those refs from the mirror to the remote
+// Mirror refs the remote rejects are rolled back. With s.WriteThrough the refs are
+// pushed to the remote first and the mirror is only updated with the accepted refs
+// By default the current branch is pushed. s.Refspecs, s.PushTags and s.AllBranches
+// select other refs
+// c is sent to the remote in a header. When it's nil the remote gets no credential
+// and the mirror remote URL is used as is
+// With s.RebaseOnReject a non-fast-forward rejection of the current branch is
+// rebased onto the remote branch and pushed once more
+// It returns the result for each ref in each hop
+func PushMirror(ctx context.Context, s config.Settings, c *Credential, log *zerolog.Logger) (results []RefResult, err error) {
+	ctx, span := tracing.Start(ctx, "mirror.push")
+	defer func() {
+		if !s.DryRun {
+			span.SetAttribute("push.refs", PushedRefs(results))
+		}
+		span.Finish(err)
+	}()
+	results, err = pushMirror(ctx, s, c, log)
+	if !s.RebaseOnReject || s.DryRun || ErrorClass(err) != ErrorClassNonFastForward {
+		return results, err
+	}
+	if len(s.Refspecs) > 0 || s.AllBranches || s.PushTags {
+		log.Warn().Msg("--rebase-on-reject only rebases the current branch. not retrying")
+		return results, err
+	}
+	mirror := NewMirror(s, log)
+	if rerr := mirror.rebaseOnRemote(ctx, s.Local, c, log); rerr != nil {
+		log.Error().Err(rerr).Msg("unable to rebase onto the remote branch")
+		return results, err
+	}
+	log.Info().Msg("rebased onto the remote branch. pushing again")
+	retry, err := pushMirror(ctx, s, c, log)
+	return append(results, retry...), err
+}
+
+// pushMirror is one attempt of PushMirror
+func pushMirror(ctx context.Context, s config.Settings, c *Credential, log *zerolog.Logger) (results []RefResult, err error) {
+	mirror := *NewMirror(s, log)
+	if err = checkClean(ctx, s.Local, log); err != nil {
+		log.Error().Msgf("Unable to push dirty repo: %s", s.Local)
+		return nil, err
+	}
+
+	refspecs, upstream, err := pushRefspecs(ctx, s, log)
+	if err != nil {
+		return nil, err
+	}
+	// a dry run of the first hop shows exactly which refs would change
+	plan, err := pushRefs(ctx, s.Local, Credential{}, HopMirror, "origin", append([]string{"--dry-run"}, upstream...), refspecs, log)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkPush(ctx, s, plan, log); err != nil {
+		return nil, err
+	}
+	if s.DryRun {
+		for _, r := range plan {
+			log.Info().Msgf("dry run: local(%s) -> mirror(%s): %s %s", s.Local, mirror.Path, r.Ref, r.Status)
+		}
+		return mirror.dryRunRemote(ctx, s, c, refspecs, plan, log)
+	}
+
+	if s.WriteThrough {
+		return mirror.pushWriteThrough(ctx, s, c, refspecs, upstream, log)
+	}
+
+	// remember the mirror refs so they can be restored if the remote rejects them
+	before, err := mirror.refValues(ctx)
+	if err != nil {
+		return nil, err
+	}
+	//Push the local refs to the mirror
+	log.Debug().Msgf("Pushing local repo(%s) to mirror(%s)", s.Local, mirror.Path)
+	results, err = pushRefs(ctx, s.Local, Credential{}, HopMirror, "origin", upstream, refspecs, log)
+	logRefResults(results, log)
+	if err != nil {
+		log.Error().Msgf("Unable to push local repo (%s) to mirror (%s)", s.Local, mirror.Path)
+		return results, err
+	}
+
+	// Push the same refs from the mirror to the remote
+	pushCredential, err := mirror.pushCredential(ctx, s, c, log)
+	if err != nil {
+		return append(results, mirror.rollback(ctx, s.Local, results, nil, before, log)...), err
+	}
+	log.Debug().Msgf("Pushing mirror(%s) to remote(%s)", mirror.Path, s.Remote)
+	remoteResults, err := pushRefs(ctx, mirror.Path, pushCredential, HopRemote, "origin",
+		[]string{"-c", "remote.origin.mirror=false"}, remoteRefspecs(results), log)
+	logRefResults(remoteResults, log)
+	if err != nil {
+		log.Error().Msgf("Unable to push mirror (%s) to remote (%s)", mirror.Path, s.Remote)
+		rolledBack := mirror.rollback(ctx, s.Local, results, remoteResults, before, log)
+		return append(append(results, remoteResults...), rolledBack...), err
+	}
+	return append(results, remoteResults...), nil
+}
+
+// pushWriteThrough pushes the local refs straight to the remote and then updates
+// the mirror to the refs the remote accepted. The mirror never holds a ref the
+// remote rejected
+func (m *Mirror) pushWriteThrough(ctx context.Context, s config.Settings, c *Credential, refspecs, upstream []string, log *zerolog.Logger) ([]RefResult, error) {
+	pushCredential, err := m.pushCredential(ctx, s, c, log)
+	if err != nil {
+		return nil, err
+	}
+	remoteURL, err := m.originURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Msgf("Pushing local repo(%s) to remote(%s)", s.Local, s.Remote)
+	results, err := pushRefs(ctx, s.Local, pushCredential, HopRemote, remoteURL, nil, refspecs, log)
+	logRefResults(results, log)
+	if err != nil {
+		log.Error().Msgf("Unable to push local repo (%s) to remote (%s). the mirror was not changed", s.Local, s.Remote)
+		return results, err
+	}
+
+	log.Debug().Msgf("Updating mirror(%s) from local repo(%s)", m.Path, s.Local)
+	mirrorResults, err := pushRefs(ctx, s.Local, Credential{}, HopMirror, "origin", upstream, acceptedRefspecs(results), log)
+	logRefResults(mirrorResults, log)
+	if err != nil {
+		// the remote has the refs. the next mirror update fetches them
+		log.Warn().Err(err).Msgf("Unable to update mirror (%s). it will catch up on the next update", m.Path)
+	}
+	return append(results, mirrorResults...), nil
+}
+
+// dryRunRemote checks the refs of a dry run against the remote without pushing
+// The local refs are compared with the remote refs, since the mirror doesn't have
+// them yet. That shows non-fast-forward rejections. Hooks on the remote don't run
+func (m *Mirror) dryRunRemote(ctx context.Context, s config.Settings, c *Credential, refspecs []string, plan []RefResult, log *zerolog.Logger) ([]RefResult, error) {
+	pushCredential, err := m.pushCredential(ctx, s, c, log)
+	if err != nil {
+		return plan, err
+	}
+	remoteURL, err := m.originURL(ctx)
+	if err != nil {
+		return plan, err
+	}
+	results, err := pushRefs(ctx, s.Local, pushCredential, HopRemote, remoteURL, []string{"--dry-run"}, refspecs, log)
+	for _, r := range results {
+		log.Info().Msgf("dry run: mirror(%s) -> remote(%s): %s %s", m.Path, config.Redact(s.Remote), r.Ref, r.Status)
+	}
+	return append(plan, results...), err
+}
+
+// originURL returns the remote URL of the mirror
+func (m *Mirror) originURL(ctx context.Context) (string, error) {
+	result, err := config.Run(ctx, []string{"git", "-C", m.Path, "remote", "get-url", "origin"})
+	if err != nil || result.ReturnCode != 0 {
+		return "", gitError("unable to get mirror remote URL", result, err)
+	}
+	return strings.TrimSpace(result.StdOut), nil
+}
+
+// acceptedRefspecs returns the local to mirror refspecs for the refs the remote accepted
+// They are forced so the mirror matches the remote
+func acceptedRefspecs(results []RefResult) []string {
+	var refspecs []string
+	for _, r := range results {
+		switch r.Status {
+		case RefRejected:
+		case RefDeleted:
+			refspecs = append(refspecs, ":"+r.Ref)
+		default:
+			refspecs = append(refspecs, "+"+r.Source+":"+r.Ref)
+		}
+	}
+	return refspecs
+}
+
+// refValues returns the commit of each mirror ref
+func (m *Mirror) refValues(ctx context.Context) (map[string]string, error) {
+	result, err := config.Run(ctx, []string{"git", "-C", m.Path, "for-each-ref", "--format=%(refname) %(objectname)"})
+	if err != nil || result.ReturnCode != 0 {
+		return nil, gitError("unable to list mirror refs", result, err)
+	}
+	refs := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(result.StdOut), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			refs[fields[0]] = fields[1]
+		}
+	}
+	return refs, nil
+}
+
+// rollback restores the mirror refs changed by the mirror push that the remote didn't accept
+// and resets the local remote tracking refs to match
+func (m *Mirror) rollback(ctx context.Context, local string, mirrorResults, remoteResults []RefResult, before map[string]string, log *zerolog.Logger) []RefResult {
+	accepted := map[string]bool{}
+	for _, r := range remoteResults {
+		if r.Status != RefRejected {
+			accepted[r.Ref] = true
+		}
+	}
+	var rolledBack []RefResult
+	for _, r := range mirrorResults {
+		if r.Status == RefRejected || r.Status == RefUpToDate || accepted[r.Ref] {
+			continue
+		}
+		command := []string{"git", "-C", m.Path, "update-ref", "--", r.Ref, before[r.Ref]}
+		if before[r.Ref] == "" {
+			command = []string{"git", "-C", m.Path, "update-ref", "-d", "--", r.Ref}
+		}
+		result, err := config.Run(ctx, command)
+		if err != nil || result.ReturnCode != 0 {
+			log.Error().Err(gitError("unable to roll back "+r.Ref, result, err)).Msgf("mirror (%s) may have refs the remote rejected", m.Path)
+			continue
+		}
+		rolledBack = append(rolledBack, RefResult{Hop: HopMirror, Ref: r.Ref, Status: RefRolledBack, Summary: before[r.Ref]})
+	}
+	logRefResults(rolledBack, log)
+	if len(rolledBack) > 0 {
+		result, err := config.Run(ctx, []string{"git", "-C", local, "fetch", "--quiet", "--prune", "origin"})
+		if err != nil || result.ReturnCode != 0 {
+			log.Warn().Err(gitError("unable to fetch mirror", result, err)).Msgf("remote tracking refs in %s may be stale", local)
+		}
+	}
+	return rolledBack
+}
+
+// PushedRefs returns the refs that were changed on the remote
+func PushedRefs(results []RefResult) []string {
+	var refs []string
+	for _, r := range results {
+		if r.Hop == HopRemote && r.Status != RefRejected && r.Status != RefUpToDate {
+			refs = append(refs, r.Ref)
+		}
+	}
+	return refs
+}
+
+// pushRefspecs returns the local refspecs to push and the extra push options
+// Without explicit refs it is the current branch, with --set-upstream
+func pushRefspecs(ctx context.Context, s config.Settings, log *zerolog.Logger) (refspecs, options []string, err error) {
+	for _, r := range s.Refspecs {
+		// git would read it as an option
+		if strings.HasPrefix(r, "-") {
+			return nil, nil, &Error{Class: ErrorClassUnsafePush, Msg: "invalid refspec " + r}
+		}
+	}
+	refspecs = append(refspecs, s.Refspecs...)
+	if s.AllBranches {
+		refspecs = append(refspecs, "refs/heads/*:refs/heads/*")
+	}
+	if s.PushTags {
+		refspecs = append(refspecs, "refs/tags/*:refs/tags/*")
+	}
+	if len(refspecs) > 0 {
+		return refspecs, nil, nil
+	}
+
+	// Get the current branch name so we can push it
+	log.Debug().Msgf("Get current branch of local repo: %s", s.Local)
+	result, _ := config.Run(ctx, []string{"git", "-C", s.Local, "branch", "--show-current"})
+	branch := strings.TrimSuffix(result.StdOut, "\n")
+	if branch == "" {
+		return nil, nil, &Error{Class: ErrorClassUnsafePush, Msg: "local repo " + s.Local + " has a detached HEAD. check out a branch to push"}
+	}
+	log.Info().Msgf("Got current branch of local repo (%s): %s", s.Local, branch)
+	return []string{"refs/heads/" + branch + ":refs/heads/" + branch}, []string{"--set-upstream"}, nil
+}
+
+// remoteRefspecs returns the mirror to remote refspecs for the refs that reached the mirror
+// Up to date refs are included. An earlier push may have stopped at the mirror
+func remoteRefspecs(results []RefResult) []string {
+	var refspecs []string
+	for _, r := range results {
+		switch r.Status {
+		case RefRejected:
+		case RefDeleted:
+			refspecs = append(refspecs, ":"+r.Ref)
+		default:
+			refspecs = append(refspecs, r.Ref+":"+r.Ref)
+		}
+	}
+	return refspecs
+}
+
+// pushRefs runs git push --porcelain to a remote name or URL in dir and returns the result of each ref
+// options go before the push subcommand when they start with -c, after it otherwise
+// "remote:" lines (ex. hook output) are logged. A rejected ref is an error classed by the rejection reason
+func pushRefs(ctx context.Context, dir string, c Credential, hop, remote string, options, refspecs []string, log *zerolog.Logger) ([]RefResult, error) {
+	args := []string{"-C", dir}
+	var pushOptions []string
+	for i := 0; i < len(options); i++ {
+		if options[i] == "-c" && i+1 < len(options) {
+			args = append(args, options[i], options[i+1])
+			i++
+			continue
+		}
+		pushOptions = append(pushOptions, options[i])
+	}
+	args = append(args, "push", "--porcelain")
+	args = append(append(args, pushOptions...), "--", remote)
+	result, err := runGit(ctx, c, append(args, refspecs...)...)
+	results := parsePorcelain(result.StdOut, hop)
+	messages := remoteMessages(result.StdErr)
+	failed := err != nil || result.ReturnCode != 0
+	for _, m := range messages {
+		event := log.Info()
+		if failed {
+			event = log.Warn()
+		}
+		event.Str("hop", hop).Msg("remote: " + m)
+	}
+	if !failed {
+		return results, nil
+	}
+	var rejected []string
+	class := ""
+	for _, r := range results {
+		if r.Status != RefRejected {
+			continue
+		}
+		rejected = append(rejected, r.Ref+" ("+r.Reason+")")
+		// the reason that needs the most attention wins
+		if c := rejectionClass(r.Reason); class == "" || exitCodes[c] > exitCodes[class] {
+			class = c
+		}
+	}
+	if len(rejected) == 0 {
+		e := gitError("unable to push to "+hop, result, err).(*Error)
+		e.RemoteMessages = messages
+		return results, e
+	}
+	return results, &Error{
+		Class:          class,
+		Msg:            hop + " rejected " + strings.Join(rejected, ", "),
+		Err:            commandError(result, err),
+		RemoteMessages: messages,
+	}
+}
+
+// rejectionReason returns the reason for a rejected ref from its porcelain summary
+// ex. "[rejected] (non-fast-forward)" or "[remote rejected] (pre-receive hook declined)"
+func rejectionReason(summary string) string {
+	summary = strings.ToLower(summary)
+	for _, s := range []string{"non-fast-forward", "fetch first", "stale info", "already exists"} {
+		if strings.Contains(summary, s) {
+			return RejectNonFastForward
+		}
+	}
+	for _, s := range []string{"permission", "denied", "protected", "not allowed", "forbidden", "unauthorized"} {
+		if strings.Contains(summary, s) {
+			return RejectPermission
+		}
+	}
+	if strings.Contains(summary, "hook") {
+		return RejectHook
+	}
+	return RejectOther
+}
+
+// rejectionClass returns the error class for a rejection reason
+func rejectionClass(reason string) string {
+	switch reason {
+	case RejectNonFastForward:
+		return ErrorClassNonFastForward
+	case RejectPermission:
+		return ErrorClassPermission
+	case RejectHook:
+		return ErrorClassHookRejected
+	default:
+		return ErrorClassGit
+	}
+}
+
+// rebaseOnRemote fetches the remote into the mirror and rebases the current branch of
+// the local repo onto it. A rebase with conflicts is aborted
+func (m *Mirror) rebaseOnRemote(ctx context.Context, local string, c *Credential, log *zerolog.Logger) error {
+	var cred Credential
+	if c != nil {
+		if err := c.Refresh(log); err != nil {
+			return &Error{Class: ErrorClassCredential, Msg: "unable to refresh credential", Err: err}
+		}
+		cred = *c
+	}
+	log.Info().Msgf("fetching remote into mirror(%s)", m.Path)
+	result, err := runGit(ctx, cred, "-C", m.Path, "fetch", "--prune", "origin")
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to fetch remote into mirror", result, err)
+	}
+	result, err = config.Run(ctx, []string{"git", "-C", local, "fetch", "--quiet", "origin"})
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to fetch mirror into "+local, result, err)
+	}
+	result, err = config.Run(ctx, []string{"git", "-C", local, "rebase", "@{upstream}"})
+	if err != nil || result.ReturnCode != 0 {
+		config.Run(ctx, []string{"git", "-C", local, "rebase", "--abort"})
+		return &Error{Class: ErrorClassNonFastForward, Msg: "rebase onto the remote branch failed. rebase by hand and push again", Err: commandError(result, err)}
+	}
+	return nil
+}
+
+// parsePorcelain parses git push --porcelain output
+// ex. "*\trefs/heads/a:refs/heads/a\t[new branch]"
+func parsePorcelain(out, hop string) []RefResult {
+	statuses := map[byte]string{' ': RefUpdated, '+': RefForced, '-': RefDeleted, '*': RefNew, '!': RefRejected, '=': RefUpToDate}
+	var results []RefResult
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) < 2 || len(fields[0]) != 1 {
+			continue
+		}
+		status, ok := statuses[fields[0][0]]
+		if !ok {
+			continue
+		}
+		from, to := "", fields[1]
+		if i := strings.Index(fields[1], ":"); i >= 0 {
+			from, to = fields[1][:i], fields[1][i+1:]
+		}
+		r := RefResult{Hop: hop, Source: from, Ref: to, Status: status}
+		if len(fields) == 3 {
+			r.Summary = fields[2]
+		}
+		if status == RefRejected {
+			r.Reason = rejectionReason(r.Summary)
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// logRefResults logs one line per ref
+func logRefResults(results []RefResult, log *zerolog.Logger) {
+	for _, r := range results {
+		event := log.Info()
+		if r.Status == RefRejected {
+			event = log.Error()
+		}
+		event = event.Str("hop", r.Hop).Str("ref", r.Ref).Str("status", r.Status)
+		if r.Reason != "" {
+			event = event.Str("reason", r.Reason)
+		}
+		event.Msg(r.Summary)
+	}
+}
+
+// pushCredential refreshes c, resets the mirror remote URL and returns the credential
+// for the git environment. It's empty when c is nil
+func (m *Mirror) pushCredential(ctx context.Context, s config.Settings, c *Credential, log *zerolog.Logger) (Credential, error) {
+	if c == nil {
+		return Credential{}, nil
+	}
+	if err := m.setRemote(ctx, *NewHTTPSRemote(s.Remote).Stripped(), c, log); err != nil {
+		return Credential{}, err
+	}
+	return *c, nil
+}
+
+// checkPush runs the pre-push safety checks on the planned ref updates
+// It refuses a protected branch, more unpushed commits than MaxUnpushed and,
+// with RequireSigned, commits without a good signature
+func checkPush(ctx context.Context, s config.Settings, plan []RefResult, log *zerolog.Logger) error {
+	var sources []string
+	for _, r := range plan {
+		if r.Status == RefUpToDate || r.Status == RefRejected {
+			continue
+		}
+		branch := strings.TrimPrefix(r.Ref, "refs/heads/")
+		for _, pattern := range s.ProtectedBranches {
+			if matched, _ := path.Match(pattern, branch); pattern != "" && matched && branch != r.Ref {
+				return &Error{Class: ErrorClassUnsafePush, Msg: fmt.Sprintf(
+					"branch %s is protected (%s). push a different branch or change --protected-branch", branch, pattern)}
+			}
+		}
+		if r.Source != "" {
+			sources = append(sources, r.Source)
+		}
+	}
+	if len(sources) == 0 {
+		log.Info().Msg("nothing to push to the mirror")
+		return nil
+	}
+
+	// compare with the mirror, not a stale remote tracking ref
+	result, err := config.Run(ctx, []string{"git", "-C", s.Local, "fetch", "--quiet", "origin"})
+	if err != nil || result.ReturnCode != 0 {
+		return gitError("unable to fetch mirror into "+s.Local, result, err)
+	}
+	commits, err := unpushedCommits(ctx, s.Local, sources)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("%d unpushed commits in %s", len(commits), strings.Join(sources, " "))
+	if s.MaxUnpushed > 0 && len(commits) > s.MaxUnpushed {
+		return &Error{Class: ErrorClassUnsafePush, Msg: fmt.Sprintf(
+			"%d unpushed commits is more than --max-unpushed %d", len(commits), s.MaxUnpushed)}
+	}
+	if s.RequireSigned {
+		for _, commit := range commits {
+			// G is a good signature. U is good with unknown validity
+			if commit.Signature != "G" && commit.Signature != "U" {
+				return &Error{Class: ErrorClassUnsafePush, Msg: fmt.Sprintf(
+					"commit %s is not signed with a trusted key (signature status %s)", commit.SHA, commit.Signature)}
+			}
+		}
+	}
+	return nil
+}
+
+// Commit is a commit and its git signature status (%G?)
+type Commit struct {
+	SHA       string
+	Signature string
+}
+
+// unpushedCommits returns the commits in the source refs that aren't on any origin branch
+func unpushedCommits(ctx context.Context, local string, sources []string) ([]Commit, error) {
+	args := append([]string{"git", "-C", local, "log", "--format=%H %G?"}, sources...)
+	result, err := config.Run(ctx, append(args, "--not", "--remotes=origin", "--"))
+	if err != nil || result.ReturnCode != 0 {
+		return nil, gitError("unable to list unpushed commits", result, err)
+	}
+	var commits []Commit
+	for _, line := range strings.Split(strings.TrimSpace(result.StdOut), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			commits = append(commits, Commit{SHA: fields[0], Signature: fields[1]})
+		}
+	}
+	return commits, nil
+}
@@ -0,0 +1,330 @@
+package types
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/natemarks/cache_clone/config"
+	"github.com/rs/zerolog"
+)
+
+func TestParsePorcelain(t *testing.T) {
+	out := "To /tmp/mirror/repo.git\n" +
+		"*\trefs/heads/a:refs/heads/a\t[new branch]\n" +
+		" \trefs/heads/main:refs/heads/main\t1a2b3c4..5d6e7f8\n" +
+		"-\t:refs/heads/old\t[deleted]\n" +
+		"!\trefs/tags/v1:refs/tags/v1\t[rejected] (already exists)\n" +
+		"=\trefs/tags/v0:refs/tags/v0\t[up to date]\n" +
+		"Done\n"
+	want := []RefResult{
+		{Hop: HopMirror, Source: "refs/heads/a", Ref: "refs/heads/a", Status: RefNew, Summary: "[new branch]"},
+		{Hop: HopMirror, Source: "refs/heads/main", Ref: "refs/heads/main", Status: RefUpdated, Summary: "1a2b3c4..5d6e7f8"},
+		{Hop: HopMirror, Source: "", Ref: "refs/heads/old", Status: RefDeleted, Summary: "[deleted]"},
+		{Hop: HopMirror, Source: "refs/tags/v1", Ref: "refs/tags/v1", Status: RefRejected, Summary: "[rejected] (already exists)", Reason: RejectNonFastForward},
+		{Hop: HopMirror, Source: "refs/tags/v0", Ref: "refs/tags/v0", Status: RefUpToDate, Summary: "[up to date]"},
+	}
+	got := parsePorcelain(out, HopMirror)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePorcelain() = %+v, want %+v", got, want)
+	}
+	wantSpecs := []string{"refs/heads/a:refs/heads/a", "refs/heads/main:refs/heads/main", ":refs/heads/old", "refs/tags/v0:refs/tags/v0"}
+	if specs := remoteRefspecs(got); !reflect.DeepEqual(specs, wantSpecs) {
+		t.Errorf("remoteRefspecs() = %v, want %v", specs, wantSpecs)
+	}
+	wantAccepted := []string{"+refs/heads/a:refs/heads/a", "+refs/heads/main:refs/heads/main", ":refs/heads/old", "+refs/tags/v0:refs/tags/v0"}
+	if specs := acceptedRefspecs(got); !reflect.DeepEqual(specs, wantAccepted) {
+		t.Errorf("acceptedRefspecs() = %v, want %v", specs, wantAccepted)
+	}
+}
+
+func TestRejectionReason(t *testing.T) {
+	tests := map[string]string{
+		"[rejected] (non-fast-forward)":                      RejectNonFastForward,
+		"[rejected] (fetch first)":                           RejectNonFastForward,
+		"[remote rejected] (pre-receive hook declined)":      RejectHook,
+		"[remote rejected] (protected branch hook declined)": RejectPermission,
+		"[remote rejected] (permission denied for refs/x)":   RejectPermission,
+		"[remote rejected] (shallow update not allowed)":     RejectPermission,
+		"[remote rejected] (missing necessary objects)":      RejectOther,
+	}
+	for summary, want := range tests {
+		if got := rejectionReason(summary); got != want {
+			t.Errorf("rejectionReason(%q) = %s, want %s", summary, got, want)
+		}
+	}
+}
+
+// pushFixture returns push settings for a local repo cloned from a mirror of a local bare
+// remote. With a reject hook the remote refuses every push
+func pushFixture(t *testing.T, reject bool) (config.Settings, *Mirror, string) {
+	t.Helper()
+	log := zerolog.Nop()
+	work, remote := t.TempDir(), filepath.Join(t.TempDir(), "remote.git")
+	git(t, "init", "-q", "-b", "main", work)
+	commit(t, work, "one")
+	git(t, "clone", "-q", "--bare", work, remote)
+	if reject {
+		hook := filepath.Join(remote, "hooks", "pre-receive")
+		if err := os.WriteFile(hook, []byte("#!/bin/sh\necho denied by policy\nexit 1\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := config.Settings{Mirror: t.TempDir(), Remote: "https://host/org/repo.git", Local: filepath.Join(t.TempDir(), "local")}
+	m := NewMirror(s, &log)
+	git(t, "clone", "-q", "--mirror", remote, m.Path)
+	git(t, "clone", "-q", m.Path, s.Local)
+	return s, m, remote
+}
+
+// commit adds an empty commit to the current branch of dir
+func commit(t *testing.T, dir, msg string) {
+	t.Helper()
+	git(t, "-C", dir, "-c", "user.name=a", "-c", "user.email=a@b", "commit", "-q", "--allow-empty", "-m", msg)
+}
+
+// refsOf returns the refs of a repo
+func refsOf(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	refs, err := (&Mirror{Path: dir}).refValues(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return refs
+}
+
+func TestPushRollback(t *testing.T) {
+	log := zerolog.Nop()
+	for _, branch := range []string{"main", "feature"} {
+		s, m, remote := pushFixture(t, true)
+		if branch != "main" {
+			git(t, "-C", s.Local, "checkout", "-q", "-b", branch)
+		}
+		commit(t, s.Local, "two")
+		mirrorBefore, remoteBefore := refsOf(t, m.Path), refsOf(t, remote)
+
+		results, err := PushMirror(context.Background(), s, nil, &log)
+		if ErrorClass(err) != ErrorClassHookRejected {
+			t.Fatalf("%s: PushMirror(context.Background()) = %v, want a hook rejection", branch, err)
+		}
+		if got := refsOf(t, m.Path); !reflect.DeepEqual(got, mirrorBefore) {
+			t.Errorf("%s: mirror refs after rollback = %v, want %v", branch, got, mirrorBefore)
+		}
+		if got := refsOf(t, remote); !reflect.DeepEqual(got, remoteBefore) {
+			t.Errorf("%s: remote refs changed: %v", branch, got)
+		}
+		last := results[len(results)-1]
+		if last.Status != RefRolledBack || last.Ref != "refs/heads/"+branch || last.Summary != mirrorBefore[last.Ref] {
+			t.Errorf("%s: last result = %+v", branch, last)
+		}
+	}
+}
+
+func TestPushWriteThrough(t *testing.T) {
+	log := zerolog.Nop()
+	s, m, remote := pushFixture(t, true)
+	s.WriteThrough = true
+	commit(t, s.Local, "two")
+	mirrorBefore := refsOf(t, m.Path)
+	if _, err := PushMirror(context.Background(), s, nil, &log); ErrorClass(err) != ErrorClassHookRejected {
+		t.Fatalf("PushMirror(context.Background()) = %v, want a hook rejection", err)
+	}
+	if got := refsOf(t, m.Path); !reflect.DeepEqual(got, mirrorBefore) {
+		t.Errorf("write-through changed the mirror after a rejection: %v, want %v", got, mirrorBefore)
+	}
+
+	s, m, remote = pushFixture(t, false)
+	s.WriteThrough = true
+	commit(t, s.Local, "two")
+	if _, err := PushMirror(context.Background(), s, nil, &log); err != nil {
+		t.Fatal(err)
+	}
+	head := git(t, "-C", s.Local, "rev-parse", "HEAD")
+	if refsOf(t, remote)["refs/heads/main"] != head || refsOf(t, m.Path)["refs/heads/main"] != head {
+		t.Errorf("remote and mirror main should be %s", head)
+	}
+}
+
+// commitFile writes a file and commits it to the current branch of dir
+func commitFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, "-C", dir, "add", name)
+	commit(t, dir, "edit "+name)
+}
+
+func TestRebaseOnReject(t *testing.T) {
+	// the rebase writes commits
+	t.Setenv("GIT_COMMITTER_NAME", "a")
+	t.Setenv("GIT_COMMITTER_EMAIL", "a@b")
+	log := zerolog.Nop()
+	for _, conflict := range []bool{false, true} {
+		s, _, remote := pushFixture(t, false)
+		s.RebaseOnReject = true
+		// someone else pushes to the remote after the mirror was fetched
+		other := filepath.Join(t.TempDir(), "other")
+		git(t, "clone", "-q", remote, other)
+		commitFile(t, other, "a.txt", "theirs\n")
+		git(t, "-C", other, "push", "-q", "origin", "main")
+		theirs := git(t, "-C", other, "rev-parse", "HEAD")
+
+		name := "b.txt"
+		if conflict {
+			name = "a.txt"
+		}
+		commitFile(t, s.Local, name, "ours\n")
+		ours := git(t, "-C", s.Local, "rev-parse", "HEAD")
+
+		_, err := PushMirror(context.Background(), s, nil, &log)
+		if conflict {
+			if ErrorClass(err) != ErrorClassNonFastForward {
+				t.Fatalf("conflicting rebase: PushMirror(context.Background()) = %v", err)
+			}
+			if status := git(t, "-C", s.Local, "status", "--porcelain"); status != "" {
+				t.Errorf("checkout isn't clean after the aborted rebase:\n%s", status)
+			}
+			if head := git(t, "-C", s.Local, "rev-parse", "HEAD"); head != ours {
+				t.Errorf("HEAD after the aborted rebase = %s, want %s", head, ours)
+			}
+			if _, err := os.Stat(filepath.Join(s.Local, ".git", "rebase-merge")); err == nil {
+				t.Error("rebase is still in progress")
+			}
+			if got := refsOf(t, remote)["refs/heads/main"]; got != theirs {
+				t.Errorf("remote main = %s, want %s", got, theirs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("PushMirror(context.Background()) after rebase = %v", err)
+		}
+		head := git(t, "-C", s.Local, "rev-parse", "HEAD")
+		if parent := git(t, "-C", s.Local, "rev-parse", "HEAD^"); head == ours || parent != theirs {
+			t.Errorf("HEAD %s (parent %s) isn't rebased onto %s", head, parent, theirs)
+		}
+		if got := refsOf(t, remote)["refs/heads/main"]; got != head {
+			t.Errorf("remote main = %s, want %s", got, head)
+		}
+	}
+}
+
+func TestPushSafetyChecks(t *testing.T) {
+	log := zerolog.Nop()
+	tests := []struct {
+		name      string
+		setup     func(t *testing.T, s *config.Settings, remote string)
+		wantClass string
+		// a dry run reports the remote hop
+		wantRemote string
+	}{
+		{"detached head", func(t *testing.T, s *config.Settings, _ string) {
+			git(t, "-C", s.Local, "checkout", "-q", "--detach")
+			commit(t, s.Local, "two")
+		}, ErrorClassUnsafePush, ""},
+		{"protected branch", func(t *testing.T, s *config.Settings, _ string) {
+			s.ProtectedBranches = []string{"release/*", "ma*"}
+			commit(t, s.Local, "two")
+		}, ErrorClassUnsafePush, ""},
+		{"unprotected branch dry run", func(t *testing.T, s *config.Settings, _ string) {
+			s.ProtectedBranches = []string{"release/*"}
+			s.DryRun = true
+			commit(t, s.Local, "two")
+		}, "", RefUpdated},
+		{"max unpushed", func(t *testing.T, s *config.Settings, _ string) {
+			s.MaxUnpushed = 1
+			commit(t, s.Local, "two")
+			commit(t, s.Local, "three")
+		}, ErrorClassUnsafePush, ""},
+		{"unsigned", func(t *testing.T, s *config.Settings, _ string) {
+			s.RequireSigned = true
+			commit(t, s.Local, "two")
+		}, ErrorClassUnsafePush, ""},
+		{"dry run", func(t *testing.T, s *config.Settings, _ string) {
+			s.DryRun = true
+			git(t, "-C", s.Local, "checkout", "-q", "-b", "feature")
+			commit(t, s.Local, "two")
+		}, "", RefNew},
+		{"dry run non-fast-forward", func(t *testing.T, s *config.Settings, remote string) {
+			s.DryRun = true
+			other := filepath.Join(t.TempDir(), "other")
+			git(t, "clone", "-q", remote, other)
+			commit(t, other, "theirs")
+			git(t, "-C", other, "push", "-q", "origin", "main")
+			commit(t, s.Local, "ours")
+		}, ErrorClassNonFastForward, RefRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, m, remote := pushFixture(t, false)
+			tt.setup(t, &s, remote)
+			mirrorBefore, remoteBefore := refsOf(t, m.Path), refsOf(t, remote)
+			results, err := PushMirror(context.Background(), s, nil, &log)
+			if ErrorClass(err) != tt.wantClass {
+				t.Fatalf("PushMirror(context.Background()) = %v, want class %q", err, tt.wantClass)
+			}
+			if got := refsOf(t, m.Path); !reflect.DeepEqual(got, mirrorBefore) {
+				t.Errorf("mirror refs changed: %v, want %v", got, mirrorBefore)
+			}
+			if got := refsOf(t, remote); !reflect.DeepEqual(got, remoteBefore) {
+				t.Errorf("remote refs changed: %v, want %v", got, remoteBefore)
+			}
+			if tt.wantRemote == "" {
+				return
+			}
+			last := results[len(results)-1]
+			if last.Hop != HopRemote || last.Status != tt.wantRemote {
+				t.Errorf("last dry run result = %+v, want remote %s", last, tt.wantRemote)
+			}
+		})
+	}
+}
+
+func TestPushRefSelection(t *testing.T) {
+	log := zerolog.Nop()
+	s, m, remote := pushFixture(t, false)
+	git(t, "-C", s.Local, "branch", "a")
+	git(t, "-C", s.Local, "checkout", "-q", "-b", "b")
+	commit(t, s.Local, "two")
+	git(t, "-C", s.Local, "tag", "v1")
+	git(t, "-C", s.Local, "checkout", "-q", "main")
+	local := refsOf(t, filepath.Join(s.Local, ".git"))
+
+	steps := []struct {
+		name   string
+		change func(s *config.Settings)
+		// ref -> commit in the mirror and the remote afterwards. "" is deleted
+		want map[string]string
+	}{
+		{"tags", func(s *config.Settings) { s.PushTags = true },
+			map[string]string{"refs/tags/v1": local["refs/tags/v1"], "refs/heads/a": ""}},
+		{"all branches", func(s *config.Settings) { s.AllBranches = true },
+			map[string]string{"refs/heads/a": local["refs/heads/a"], "refs/heads/b": local["refs/heads/b"]}},
+		{"refspecs", func(s *config.Settings) { s.Refspecs = []string{":refs/heads/a", "refs/heads/b:refs/heads/c"} },
+			map[string]string{"refs/heads/a": "", "refs/heads/c": local["refs/heads/b"], "refs/heads/b": local["refs/heads/b"]}},
+	}
+	for _, step := range steps {
+		settings := s
+		step.change(&settings)
+		results, err := PushMirror(context.Background(), settings, nil, &log)
+		if err != nil {
+			t.Fatalf("%s: PushMirror(context.Background()) = %v", step.name, err)
+		}
+		for _, dir := range []string{m.Path, remote} {
+			refs := refsOf(t, dir)
+			for ref, want := range step.want {
+				if refs[ref] != want {
+					t.Errorf("%s: %s %s = %q, want %q", step.name, dir, ref, refs[ref], want)
+				}
+			}
+		}
+		if step.name == "refspecs" {
+			pushed := PushedRefs(results)
+			if !reflect.DeepEqual(pushed, []string{"refs/heads/a", "refs/heads/c"}) {
+				t.Errorf("pushed refs = %v", pushed)
+			}
+		}
+	}
+}
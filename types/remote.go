@@ -3,7 +3,14 @@ package types
 // TODO: simplify remote functions by getting rid of the struct and just using the functions
 import (
 	"fmt"
+	"net"
 	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/natemarks/cache_clone/config"
 )
 
 // HTTPSRemote is a struct that represents a remote git repository
@@ -14,27 +21,186 @@ type HTTPSRemote struct {
 }
 
 // ConnectionString returns the connection string for the remote
-func (r HTTPSRemote) ConnectionString(c Credential) string {
-	r.URL.User = url.UserPassword(c.Username, c.Token)
-	return r.URL.String()
+// It has no userinfo. The credential is sent in a header (Credential.GitEnv), so it
+// isn't saved in the mirror config
+func (r HTTPSRemote) ConnectionString() string {
+	u := *r.URL
+	u.User = nil
+	return u.String()
 }
 
 // NewHTTPSRemote returns a HTTPSRemote struct from a remote URL
+// It panics if the URL is invalid
 func NewHTTPSRemote(remoteURL string) *HTTPSRemote {
-	u, err := url.Parse(remoteURL)
+	r, err := NewRemote(remoteURL)
 	if err != nil {
 		panic(err)
 	}
+	return r
+}
+
+// NewRemote returns a HTTPSRemote struct from a remote URL
+func NewRemote(remoteURL string) (*HTTPSRemote, error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return nil, config.RedactError(err)
+	}
 	if u.Host == "" || u.Path == "" {
-		panic(fmt.Errorf("unable to determine host or path from: %s", remoteURL))
+		return nil, config.RedactError(fmt.Errorf("unable to determine host or path from: %s", remoteURL))
+	}
+	if err = checkRemote(u); err != nil {
+		return nil, config.RedactError(fmt.Errorf("unsafe remote %s: %w", remoteURL, err))
 	}
 	ff, err := url.Parse(remoteURL)
 	if err != nil {
-		panic(err)
+		return nil, config.RedactError(err)
 	}
 	return &HTTPSRemote{
 		Host: u.Host,
 		Path: u.Path,
 		URL:  ff,
+	}, nil
+}
+
+// hostPattern matches a host name or bracketed IP address with an optional port
+var hostPattern = regexp.MustCompile(`^(\[[0-9A-Fa-f:.]+\]|[A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?)(:[0-9]{1,5})?$`)
+
+// checkRemote refuses a remote whose host or path could place its mirror outside
+// the mirror root or be read as a git option
+// The path is checked after percent-decoding, so encoded separators and dots count
+func checkRemote(u *url.URL) error {
+	if !hostPattern.MatchString(u.Host) {
+		return fmt.Errorf("invalid host %q", u.Host)
+	}
+	if !strings.HasPrefix(u.Path, "/") {
+		return fmt.Errorf("path must be absolute")
+	}
+	for _, part := range strings.Split(u.Path, "/") {
+		if part == "." || part == ".." {
+			return fmt.Errorf("path has a %q component", part)
+		}
+		if strings.HasPrefix(part, "-") {
+			return fmt.Errorf("path component %q starts with -", part)
+		}
+		for _, c := range part {
+			if c == '\\' || c < 0x20 || c == 0x7f {
+				return fmt.Errorf("path component %q has a backslash or control character", part)
+			}
+		}
+	}
+	return nil
+}
+
+// MirrorPath returns the mirror directory of a remote under the mirror root
+// It is an error if the directory would be the root or outside it
+func MirrorPath(root string, r HTTPSRemote) (string, error) {
+	p := config.JoinPaths(root, r.Host, r.Path)
+	rel, err := filepath.Rel(filepath.Clean(root), p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("mirror of %s is outside the mirror root %s", config.Redact(r.URL.String()), root)
+	}
+	return p, nil
+}
+
+// defaultPorts are dropped from remote hosts
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// Bitbucket Server repo paths, after any context path
+// web: /projects/PROJ/repos/repo/browse or /users/bob/repos/repo
+// clone: /scm/proj/repo.git or /scm/~bob/repo.git
+var (
+	bitbucketWebPattern = regexp.MustCompile(`^(.*?)/(projects|users)/([^/]+)/repos/([^/]+)(/.*)?$`)
+	bitbucketSCMPattern = regexp.MustCompile(`^(.*?)/scm/([^/]+)/([^/]+)$`)
+)
+
+// Normalize returns the canonical form of the remote so equivalent URLs share one mirror
+// The host is lower case without the default port, then renamed by s.HostAliases.
+// The path has no duplicate or trailing slashes and ends in .git. On s.BitbucketHosts
+// web URLs become /scm/ clone URLs, with the project key in lower case. The
+// userinfo, query and fragment are dropped.
+// It only names the mirror. Fetch from the remote itself (Stripped), the server may not
+// know the normalized URL
+func (r HTTPSRemote) Normalize(s config.Settings) *HTTPSRemote {
+	u := *r.URL
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	u.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if h, port, err := net.SplitHostPort(host); err == nil && defaultPorts[u.Scheme] == port {
+		host = h
+	}
+	host = CanonicalHost(host, s.HostAliases)
+
+	p := path.Clean("/" + u.Path)
+	if isBitbucket(s, host) {
+		p = normalizeBitbucket(p)
+	}
+	p = strings.TrimSuffix(p, ".git") + ".git"
+
+	u.Host = host
+	u.Path = p
+	u.RawPath = ""
+	return &HTTPSRemote{Host: host, Path: p, URL: &u}
+}
+
+// Stripped returns the remote without the userinfo, to fetch from
+func (r HTTPSRemote) Stripped() *HTTPSRemote {
+	u := *r.URL
+	u.User = nil
+	return &HTTPSRemote{Host: r.Host, Path: r.Path, URL: &u}
+}
+
+// isBitbucket returns true if host is one of s.BitbucketHosts or an alias of one
+func isBitbucket(s config.Settings, host string) bool {
+	host = CanonicalHost(host, s.HostAliases)
+	for _, h := range s.BitbucketHosts {
+		if CanonicalHost(h, s.HostAliases) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeBitbucket returns the /scm/ clone path of a Bitbucket Server repo path
+func normalizeBitbucket(p string) string {
+	if m := bitbucketWebPattern.FindStringSubmatch(p); m != nil {
+		project := strings.ToLower(m[3])
+		if m[2] == "users" {
+			project = "~" + project
+		}
+		return m[1] + "/scm/" + project + "/" + m[4]
+	}
+	if m := bitbucketSCMPattern.FindStringSubmatch(p); m != nil {
+		return m[1] + "/scm/" + strings.ToLower(m[2]) + "/" + m[3]
+	}
+	return p
+}
+
+// CanonicalHost returns the canonical name of a host known under several names
+// aliases maps each alias to its canonical host. Hosts are compared without case
+func CanonicalHost(host string, aliases map[string]string) string {
+	for alias, canonical := range aliases {
+		if strings.EqualFold(alias, host) {
+			return strings.ToLower(canonical)
+		}
+	}
+	return strings.ToLower(host)
+}
+
+// AllowedHost returns true if the credential can be sent to host
+// Only the s.Remote host and s.AllowedHosts are allowed, so a mirror or request
+// for another server never gets the credential. Aliases of those hosts are allowed
+func AllowedHost(s config.Settings, host string) bool {
+	hosts := append([]string{}, s.AllowedHosts...)
+	if remote, err := NewRemote(s.Remote); err == nil {
+		hosts = append(hosts, remote.Normalize(s).Host)
+	}
+	host = CanonicalHost(host, s.HostAliases)
+	for _, h := range hosts {
+		if CanonicalHost(h, s.HostAliases) == host {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,81 @@
+package types
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/natemarks/cache_clone/config"
+)
+
+// Report is the machine readable summary of a clone or push run
+type Report struct {
+	Command    string `json:"command"`
+	Remote     string `json:"remote"`
+	MirrorPath string `json:"mirror_path"`
+	Local      string `json:"local"`
+	// created, updated or reused
+	MirrorAction string `json:"mirror_action,omitempty"`
+	// bundle store key the mirror was created from
+	MirrorBundle string `json:"mirror_bundle,omitempty"`
+	// fork network whose object store the mirror shares
+	MirrorNetwork        string  `json:"mirror_network,omitempty"`
+	FetchDurationSeconds float64 `json:"fetch_duration_seconds"`
+	BytesTransferred     int64   `json:"bytes_transferred"`
+	// the mirror wasn't fetched because of --offline, or because the remote
+	// couldn't be reached with --allow-stale. StaleError is the fetch error
+	Offline    bool     `json:"offline,omitempty"`
+	Stale      bool     `json:"stale,omitempty"`
+	StaleError string   `json:"stale_error,omitempty"`
+	CommitSHA  string   `json:"commit_sha,omitempty"`
+	PushedRefs []string `json:"pushed_refs,omitempty"`
+	// result of each ref in each push hop
+	RefResults []RefResult `json:"ref_results,omitempty"`
+	// "remote:" lines from a failed push. ex. pre-receive hook output
+	RemoteMessages  []string  `json:"remote_messages,omitempty"`
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Success         bool      `json:"success"`
+	ErrorClass      string    `json:"error_class,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// NewReport returns a report for a command that is starting now
+func NewReport(command string, s config.Settings) *Report {
+	return &Report{
+		Command: command,
+		Remote:  config.Redact(s.Remote),
+		Local:   s.Local,
+		Started: time.Now(),
+	}
+}
+
+// SetMirror records the mirror path and the result of the last clone or fetch
+func (r *Report) SetMirror(m *Mirror) {
+	r.MirrorPath = m.Path
+	r.MirrorAction = m.Action
+	r.MirrorBundle = m.Bundle
+	r.MirrorNetwork = m.SharedNetwork()
+	r.FetchDurationSeconds = m.FetchDuration.Seconds()
+	r.BytesTransferred = m.BytesTransferred
+}
+
+// Finish records the run duration and the final error, if any
+func (r *Report) Finish(err error) {
+	r.DurationSeconds = time.Since(r.Started).Seconds()
+	r.Success = err == nil
+	r.ErrorClass = ErrorClass(err)
+	if err != nil {
+		r.Error = config.Redact(err.Error())
+		r.RemoteMessages = RemoteMessages(err)
+	}
+}
+
+// Write writes the report to a JSON file
+func (r Report) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}